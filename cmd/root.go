@@ -88,3 +88,23 @@ func initConfig() {
 		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
 	}
 }
+
+// bindFlags binds cmd's flags to the given viper config keys, so they
+// can be set from the config file or environment as well.
+func bindFlags(cmd *cobra.Command, keys map[string]string) {
+	for name, key := range keys {
+		cobra.CheckErr(viper.BindPFlag(key, cmd.Flags().Lookup(name)))
+	}
+}
+
+// bindChangedFlags binds cmd's flags to the given viper config keys,
+// like bindFlags, but only the ones set on the command line. It's for
+// flags setting optional sections of the config, which would be
+// enabled by their defaults otherwise.
+func bindChangedFlags(cmd *cobra.Command, keys map[string]string) {
+	for name, key := range keys {
+		if f := cmd.Flags().Lookup(name); f.Changed {
+			cobra.CheckErr(viper.BindPFlag(key, f))
+		}
+	}
+}
@@ -4,36 +4,339 @@ Copyright © 2023 Austin Poor <code@austinpoor.com>
 package cmd
 
 import (
-	"fmt"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"github.com/a-poor/red-tape/pkg/conf"
+	"github.com/a-poor/red-tape/pkg/proxy"
+	"github.com/charmbracelet/log"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 // runCmd represents the run command
 var runCmd = &cobra.Command{
 	Use:   "run",
 	Short: "Run a red-tape reverse proxy server.",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
-
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
-	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("run called")
+	Long: `Run a red-tape reverse proxy server.
+
+Requests are proxied to the destination URL, with faults injected
+along the way. For example:
+
+  red-tape run --dest http://localhost:3000 --pre-delay-rate 0.01 --pre-delay-max 500
+
+In forward mode, red-tape is an explicit proxy for clients using
+HTTP_PROXY and HTTPS_PROXY, and rules from the config file can set
+the faults per destination host. In socks5 mode, red-tape is a SOCKS5
+proxy, with rules matching on destination host and port.
+
+Settings can also be read from the config file or environment.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		bindChangedFlags(cmd, sectionFlags)
+		c, err := conf.Load(viper.GetViper())
+		if err != nil {
+			return err
+		}
+		logger := log.Default()
+		c.Proxy.Logger = logger
+
+		// Open the access log...
+		if c.AccessLog.Path != "" {
+			a, err := proxy.MakeAccessLog(&c.AccessLog)
+			if err != nil {
+				return err
+			}
+			defer a.Close()
+			c.Proxy.Observers = append(c.Proxy.Observers, a)
+		}
+
+		// Start recording...
+		if c.Record.Path != "" {
+			rec, err := proxy.MakeRecorder(&c.Record)
+			if err != nil {
+				return err
+			}
+			defer rec.Close()
+			c.Proxy.Recorder = rec
+		}
+
+		// Start exporting traces...
+		if c.Tracing.Endpoint != "" {
+			c.Tracing.Logger = logger
+			tr, err := proxy.MakeTracer(&c.Tracing)
+			if err != nil {
+				return err
+			}
+			defer tr.Close()
+			c.Proxy.Tracer = tr
+		}
+
+		// Load the scenario...
+		var sc *proxy.Scenario
+		if c.Scenario != "" {
+			if sc, err = conf.LoadScenario(c.Scenario); err != nil {
+				return err
+			}
+			c.Proxy.Live = &proxy.LiveFaults{}
+		}
+
+		// Configure TLS...
+		var tc *tls.Config
+		if c.TLS.Enabled {
+			c.TLS.Seed = c.Proxy.Seed
+			c.TLS.Logger = logger
+			if tc, err = proxy.MakeServerTLSConfig(&c.TLS.ServerTLSConfig); err != nil {
+				return err
+			}
+		}
+
+		// Start listening...
+		l, err := proxy.Listen(&proxy.ListenConfig{
+			Addr:       c.Listen,
+			SocketMode: c.SocketMode,
+			TLS:        tc,
+		})
+		if err != nil {
+			return err
+		}
+		logger.Info("Listening.", "addr", l.Addr(), "mode", c.Mode, "dest", c.Proxy.DestURL, "tls", c.TLS.Enabled)
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		// Start the admin listener...
+		if c.AdminListen != "" {
+			m, err := proxy.MakeMetrics(&c.Metrics)
+			if err != nil {
+				return err
+			}
+			c.Proxy.Metrics = m
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", m)
+			if err := serveAdmin(ctx, c.AdminListen, mux, logger); err != nil {
+				return err
+			}
+		}
+
+		// Run the scenario...
+		if sc != nil {
+			go func() {
+				if err := sc.Run(ctx, c.Proxy.Live, logger); err != nil && !errors.Is(err, context.Canceled) {
+					logger.Error("Scenario failed.", "err", err)
+				}
+			}()
+		}
+
+		// Serve SOCKS5 until interrupted...
+		if c.Mode == conf.ModeSOCKS5 {
+			s, err := proxy.MakeSOCKS5Server(&c.Proxy, &c.SOCKS5)
+			if err != nil {
+				return err
+			}
+			go func() {
+				<-ctx.Done()
+				l.Close()
+			}()
+			return s.Serve(l)
+		}
+
+		// Create the proxy...
+		var h http.Handler
+		switch c.Mode {
+		case conf.ModeForward:
+			h, err = proxy.MakeForwardProxy(&c.Proxy)
+		default:
+			h, err = proxy.MakeProxy(&c.Proxy)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Serve HTTP until interrupted...
+		srv := &http.Server{Handler: h}
+		go func() {
+			<-ctx.Done()
+			srv.Shutdown(context.Background())
+		}()
+		if err := srv.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
 	},
 }
 
+// sectionFlags are the flags for optional sections of the config,
+// which are only bound if they're set.
+var sectionFlags = map[string]string{
+	"load-model":                  "load.model",
+	"load-base":                   "load.base",
+	"load-k":                      "load.k",
+	"load-power":                  "load.power",
+	"load-servers":                "load.servers",
+	"load-service-time":           "load.service-time",
+	"stream-event-delay-rate":     "stream.event-delay-rate",
+	"stream-event-delay-max":      "stream.event-delay-max",
+	"stream-prob-drop-event":      "stream.prob-drop-event",
+	"stream-max-events":           "stream.max-events",
+	"stream-prob-stall-heartbeat": "stream.prob-stall-heartbeat",
+	"stream-heartbeat-stall":      "stream.heartbeat-stall",
+}
+
+// serveAdmin serves the admin handler on addr, until ctx is done.
+func serveAdmin(ctx context.Context, addr string, h http.Handler, logger log.Logger) error {
+	l, err := proxy.Listen(&proxy.ListenConfig{Addr: addr})
+	if err != nil {
+		return err
+	}
+	logger.Info("Admin listening.", "addr", l.Addr())
+	srv := &http.Server{Handler: h}
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+	go srv.Serve(l)
+	return nil
+}
+
 func init() {
 	rootCmd.AddCommand(runCmd)
 
-	// Here you will define your flags and configuration settings.
+	f := runCmd.Flags()
+	f.String("listen", ":8080", "address to listen on (host:port or unix:///path/to.sock)")
+	f.String("socket-mode", "0660", "permissions for the listener's unix socket file")
+	f.String("admin-listen", "", "address for the admin listener serving /metrics")
+	f.StringSlice("metrics-labels", []string{proxy.LabelRule, proxy.LabelUpstream, proxy.LabelStatus}, "labels to break metrics down by")
+	f.Bool("metrics-status-class", false, "report status codes by class (e.g. 5xx) in metrics")
+	f.String("otlp-endpoint", "", "OTLP/HTTP endpoint to export traces to (e.g. http://localhost:4318/v1/traces)")
+	f.String("otlp-service-name", "red-tape", "service name to report in traces")
+	f.String("access-log", "", "file to write the access log to (- for stdout)")
+	f.String("access-log-format", proxy.AccessLogJSON, "access log format (json or logfmt)")
+	f.Int("access-log-max-size-mb", 0, "rotate the access log at this size (0 means never)")
+	f.Int("access-log-max-backups", 0, "number of rotated access logs to keep (0 keeps all)")
+	f.String("scenario", "", "scenario file describing phases of faults to run through")
+	f.String("record", "", "file to record proxied traffic to (.har for HAR, otherwise JSONL)")
+	f.String("record-format", "", "recording format (har or jsonl, default from the file extension)")
+	f.Int("record-max-body", proxy.DefaultRecordMaxBody, "maximum body bytes recorded per request and response")
+	f.StringSlice("record-redact-headers", proxy.DefaultRedactHeaders, "headers whose values are redacted from recordings")
+	f.String("replay", "", "recording (HAR or JSONL) to serve responses from instead of the destination")
+	f.Bool("replay-match-body", false, "match replayed requests on their body as well as method, path and query")
+	f.String("replay-unmatched", proxy.ReplayFail, "what to do with requests missing from the recording (fail or pass)")
+	f.String("dest", "", "destination URL to proxy requests to (http, https or unix:///path/to.sock)")
+	f.String("mode", conf.ModeReverse, "proxy mode (reverse, forward or socks5)")
+	f.String("socks5-username", "", "username SOCKS5 clients must authenticate with")
+	f.String("socks5-password", "", "password SOCKS5 clients must authenticate with")
+	f.Float64("prob-drop", 0, "probability of dropping a request")
+	f.Float64("pre-delay-rate", 0, "rate of the exponential delay before a request is sent (1/ms)")
+	f.Float64("pre-delay-max", 0, "maximum delay before a request is sent (ms)")
+	f.Float64("post-delay-rate", 0, "rate of the exponential delay after a response is received (1/ms)")
+	f.Float64("post-delay-max", 0, "maximum delay after a response is received (ms)")
+	f.Float64("prob-error", 0, "probability of responding with an error status instead of sending a request")
+	f.Int("error-status", http.StatusServiceUnavailable, "status to respond with for injected errors")
+	f.String("load-model", proxy.LoadPower, "load-dependent latency model (power or mmc)")
+	f.Float64("load-base", 0, "power load model: delay with nothing else in flight (ms)")
+	f.Float64("load-k", 0, "power load model: delay per in-flight request (ms)")
+	f.Float64("load-power", 1, "power load model: exponent applied to the in-flight count")
+	f.Int("load-servers", 0, "mmc load model: number of servers")
+	f.Float64("load-service-time", 0, "mmc load model: mean service time (ms)")
+	f.Int("max-concurrent", 0, "maximum requests in flight upstream, queueing the rest (0 means no limit)")
+	f.Int("queue-depth", 0, "maximum requests waiting for a slot, rejecting the rest with a 503")
+	f.Float64("queue-max-wait", 0, "maximum time a request waits in the queue before a 503 (ms, 0 means no limit)")
+	f.String("queue-order", proxy.QueueFIFO, "order queued requests are let through in (fifo or lifo)")
+	f.Float64("queue-overflow-delay", 0, "delay requests by this much per queued request when the queue is full, instead of rejecting them (ms)")
+	f.Float64("prob-net-error", 0, "probability of failing a request with a network error instead of sending it")
+	f.StringSlice("net-errors", nil, "kinds of network error to inject (timeout, conn-reset, conn-refused or dns; default all)")
+	f.Bool("client-faults", false, "let clients set faults with X-Red-Tape-Delay, -Status and -Drop request headers")
+	f.StringSlice("client-faults-allowed-cidrs", nil, "client IPs or CIDRs allowed to set faults with headers (default any)")
+	f.Bool("annotate-headers", false, "add X-Red-Tape-* headers describing injected faults to responses")
+	f.Uint64("seed", 0, "seed for the random number generator (0 means no seed)")
+
+	// Stream flags...
+	f.Float64("stream-event-delay-rate", 0, "rate of the exponential delay before each streamed event (1/ms)")
+	f.Float64("stream-event-delay-max", 0, "maximum delay before each streamed event (ms)")
+	f.Float64("stream-prob-drop-event", 0, "probability of dropping a streamed event")
+	f.Int("stream-max-events", 0, "cut streams after this many events (0 means never)")
+	f.Float64("stream-prob-stall-heartbeat", 0, "probability of stalling an SSE heartbeat")
+	f.Float64("stream-heartbeat-stall", 0, "how long to stall SSE heartbeats for (ms)")
+
+	// TLS termination flags...
+	f.Bool("tls", false, "terminate TLS for incoming connections")
+	f.String("tls-cert", "", "certificate to serve (default is issued from a local CA)")
+	f.String("tls-key", "", "key for the certificate to serve")
+	f.String("tls-ca-dir", "", "directory to load or store the local CA in")
+	f.StringSlice("tls-hosts", nil, "hosts to issue local certificates for")
+	f.Float64("tls-handshake-delay-rate", 0, "rate of the exponential tls handshake delay (1/ms)")
+	f.Float64("tls-handshake-delay-max", 0, "maximum tls handshake delay (ms)")
+	f.Float64("tls-prob-handshake-fail", 0, "probability of failing the tls handshake")
+	f.Float64("tls-prob-expired-cert", 0, "probability of serving an expired certificate")
+	f.Float64("tls-prob-wrong-host-cert", 0, "probability of serving a certificate for the wrong host")
 
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// runCmd.PersistentFlags().String("foo", "", "A help for foo")
+	// Upstream TLS flags...
+	f.String("upstream-ca", "", "CA bundle to verify the upstream with")
+	f.String("upstream-cert", "", "client certificate to present to the upstream")
+	f.String("upstream-key", "", "key for the upstream client certificate")
+	f.String("upstream-server-name", "", "server name to verify the upstream's certificate against")
+	f.Bool("upstream-insecure", false, "skip verifying the upstream's certificate")
 
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// runCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	bindFlags(runCmd, map[string]string{
+		"listen":                      "listen",
+		"socket-mode":                 "socket-mode",
+		"admin-listen":                "admin-listen",
+		"metrics-labels":              "metrics.labels",
+		"metrics-status-class":        "metrics.status-class",
+		"otlp-endpoint":               "tracing.endpoint",
+		"otlp-service-name":           "tracing.service-name",
+		"access-log":                  "access-log.path",
+		"access-log-format":           "access-log.format",
+		"access-log-max-size-mb":      "access-log.max-size-mb",
+		"access-log-max-backups":      "access-log.max-backups",
+		"scenario":                    "scenario",
+		"record":                      "record.path",
+		"record-format":               "record.format",
+		"record-max-body":             "record.max-body-bytes",
+		"record-redact-headers":       "record.redact-headers",
+		"replay":                      "replay.path",
+		"replay-match-body":           "replay.match-body",
+		"replay-unmatched":            "replay.unmatched",
+		"dest":                        "dest-url",
+		"mode":                        "mode",
+		"socks5-username":             "socks5.username",
+		"socks5-password":             "socks5.password",
+		"prob-drop":                   "prob-drop",
+		"pre-delay-rate":              "pre-delay-rate",
+		"pre-delay-max":               "pre-delay-max",
+		"post-delay-rate":             "post-delay-rate",
+		"post-delay-max":              "post-delay-max",
+		"prob-error":                  "prob-error",
+		"error-status":                "error-status",
+		"max-concurrent":              "concurrency.max-concurrent",
+		"queue-depth":                 "concurrency.queue-depth",
+		"queue-max-wait":              "concurrency.max-wait",
+		"queue-order":                 "concurrency.order",
+		"queue-overflow-delay":        "concurrency.overflow-delay",
+		"prob-net-error":              "prob-net-error",
+		"net-errors":                  "net-errors",
+		"client-faults":               "client-faults.enabled",
+		"client-faults-allowed-cidrs": "client-faults.allowed-cidrs",
+		"seed":                        "seed",
+		"annotate-headers":            "annotate-headers",
+		"tls":                         "tls.enabled",
+		"tls-cert":                    "tls.cert-file",
+		"tls-key":                     "tls.key-file",
+		"tls-ca-dir":                  "tls.ca-dir",
+		"tls-hosts":                   "tls.hosts",
+		"tls-handshake-delay-rate":    "tls.handshake-delay-rate",
+		"tls-handshake-delay-max":     "tls.handshake-delay-max",
+		"tls-prob-handshake-fail":     "tls.prob-handshake-fail",
+		"tls-prob-expired-cert":       "tls.prob-expired-cert",
+		"tls-prob-wrong-host-cert":    "tls.prob-wrong-host-cert",
+		"upstream-ca":                 "upstream-tls.ca-file",
+		"upstream-cert":               "upstream-tls.cert-file",
+		"upstream-key":                "upstream-tls.key-file",
+		"upstream-server-name":        "upstream-tls.server-name",
+		"upstream-insecure":           "upstream-tls.insecure-skip-verify",
+	})
 }
@@ -0,0 +1,87 @@
+/*
+Copyright © 2023 Austin Poor <code@austinpoor.com>
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/a-poor/red-tape/pkg/conf"
+	"github.com/a-poor/red-tape/pkg/proxy"
+	"github.com/a-poor/red-tape/pkg/stub"
+	"github.com/charmbracelet/log"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// stubCmd represents the stub command
+var stubCmd = &cobra.Command{
+	Use:   "stub",
+	Short: "Run a dummy backend to proxy requests to.",
+	Long: `Run a dummy backend to proxy requests to.
+
+By default, the stub serves:
+
+  /echo       the request, as JSON
+  /json       a fixed JSON body
+  /bytes      random bytes (?size=1024)
+  /stream     Server-Sent Events (?events=10&interval=100)
+  /slow       an empty response, after a delay (?delay=1000)
+  /status/N   an empty response with status N
+
+Every endpoint accepts a ?delay= in ms. Routes can be replaced with
+"stub.routes" in the config file. For example:
+
+  red-tape stub --listen :3000 &
+  red-tape run --dest http://localhost:3000 --pre-delay-rate 0.01 --pre-delay-max 500`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c, err := conf.Load(viper.GetViper())
+		if err != nil {
+			return err
+		}
+		logger := log.Default()
+		c.Stub.Logger = logger
+
+		// Create the handler...
+		h, err := stub.MakeHandler(&c.Stub)
+		if err != nil {
+			return err
+		}
+
+		// Start listening...
+		l, err := proxy.Listen(&proxy.ListenConfig{Addr: c.Stub.Listen})
+		if err != nil {
+			return err
+		}
+		logger.Info("Stub listening.", "addr", l.Addr())
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		// Serve until interrupted...
+		srv := &http.Server{Handler: h}
+		go func() {
+			<-ctx.Done()
+			srv.Shutdown(context.Background())
+		}()
+		if err := srv.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(stubCmd)
+
+	f := stubCmd.Flags()
+	f.String("listen", ":9000", "address to listen on (host:port or unix:///path/to.sock)")
+
+	bindFlags(stubCmd, map[string]string{
+		"listen": "stub.listen",
+	})
+}
@@ -0,0 +1,115 @@
+package conf
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/a-poor/red-tape/pkg/proxy"
+	"github.com/a-poor/red-tape/pkg/stub"
+	"github.com/spf13/viper"
+)
+
+// Config is red-tape's top-level configuration, as read from a
+// config file, environment variables and command-line flags.
+type Config struct {
+	// The address to listen on, either "host:port" or
+	// "unix:///path/to/red-tape.sock"
+	Listen string `mapstructure:"listen"`
+
+	// The permissions for the listener's Unix socket file
+	SocketMode os.FileMode `mapstructure:"socket-mode"`
+
+	// The address for the admin listener, serving /metrics (if
+	// empty, there's no admin listener)
+	AdminListen string `mapstructure:"admin-listen"`
+
+	// A scenario file to run (if empty, the faults don't change)
+	Scenario string `mapstructure:"scenario"`
+
+	// The proxy mode (ModeReverse, ModeForward or ModeSOCKS5)
+	Mode string `mapstructure:"mode"`
+
+	// The proxy's upstream and fault settings
+	Proxy proxy.ProxyConfig `mapstructure:",squash"`
+
+	// TLS settings for the listener
+	TLS TLSConfig `mapstructure:"tls"`
+
+	// Settings for the metrics served by the admin listener
+	Metrics proxy.MetricsConfig `mapstructure:"metrics"`
+
+	// Settings for the access log (if the path is empty, there's
+	// no access log)
+	AccessLog proxy.AccessLogConfig `mapstructure:"access-log"`
+
+	// Settings for recording traffic (if the path is empty, nothing
+	// is recorded)
+	Record proxy.RecordConfig `mapstructure:"record"`
+
+	// Settings for exporting traces (if the endpoint is empty,
+	// tracing is disabled)
+	Tracing proxy.TracingConfig `mapstructure:"tracing"`
+
+	// Settings for the SOCKS5 listener
+	SOCKS5 proxy.SOCKS5Config `mapstructure:"socks5"`
+
+	// Settings for the stub backend (used by "red-tape stub")
+	Stub stub.Config `mapstructure:"stub"`
+}
+
+// The proxy modes red-tape can run in.
+const (
+	// ModeReverse proxies every request to the destination URL
+	ModeReverse = "reverse"
+
+	// ModeForward runs an explicit forward proxy (HTTP_PROXY)
+	ModeForward = "forward"
+
+	// ModeSOCKS5 runs a SOCKS5 proxy
+	ModeSOCKS5 = "socks5"
+)
+
+// TLSConfig configures TLS termination for red-tape's listener.
+type TLSConfig struct {
+	// Whether to terminate TLS at all
+	Enabled bool `mapstructure:"enabled"`
+
+	proxy.ServerTLSConfig `mapstructure:",squash"`
+}
+
+// Load reads a Config from v.
+func Load(v *viper.Viper) (*Config, error) {
+	var c Config
+	if err := v.Unmarshal(&c); err != nil {
+		return nil, err
+	}
+	switch c.Mode {
+	case "":
+		c.Mode = ModeReverse
+	case ModeReverse, ModeForward, ModeSOCKS5:
+	default:
+		return nil, fmt.Errorf("unknown mode %q", c.Mode)
+	}
+	if err := c.Proxy.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// LoadScenario reads a Scenario from a file (in any format viper
+// supports, like YAML).
+func LoadScenario(path string) (*proxy.Scenario, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
+	}
+	var s proxy.Scenario
+	if err := v.Unmarshal(&s); err != nil {
+		return nil, err
+	}
+	if err := s.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid scenario %s: %w", path, err)
+	}
+	return &s, nil
+}
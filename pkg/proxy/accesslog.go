@@ -0,0 +1,281 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-logfmt/logfmt"
+)
+
+// The access log formats.
+const (
+	AccessLogJSON   = "json"
+	AccessLogLogfmt = "logfmt"
+)
+
+// AccessLogConfig configures red-tape's access log.
+type AccessLogConfig struct {
+	// The file to write to ("-" writes to stdout)
+	Path string `mapstructure:"path"`
+
+	// The record format, either AccessLogJSON or AccessLogLogfmt
+	// (defaults to AccessLogJSON)
+	Format string `mapstructure:"format"`
+
+	// Rotate the file once it reaches this many megabytes
+	// (0 means never)
+	MaxSizeMB int `mapstructure:"max-size-mb"`
+
+	// The number of rotated files to keep (0 keeps them all)
+	MaxBackups int `mapstructure:"max-backups"`
+}
+
+// AccessLog writes one structured record per request, including
+// each fault injected into it.
+type AccessLog struct {
+	format string
+
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// accessRecord is a single access log record.
+type accessRecord struct {
+	Time            time.Time     `json:"time"`
+	Method          string        `json:"method"`
+	URL             string        `json:"url"`
+	ClientIP        string        `json:"client_ip"`
+	Upstream        string        `json:"upstream"`
+	Rule            string        `json:"rule,omitempty"`
+	Status          int           `json:"status"`
+	Error           string        `json:"error,omitempty"`
+	BytesIn         int64         `json:"bytes_in"`
+	BytesOut        int64         `json:"bytes_out"`
+	PreDelay        string        `json:"pre_delay"`
+	UpstreamLatency string        `json:"upstream_latency"`
+	PostDelay       string        `json:"post_delay"`
+	AddedDelay      string        `json:"added_delay"`
+	Duration        string        `json:"duration"`
+	Faults          []accessFault `json:"faults"`
+}
+
+// accessFault is a fault decision in an access log record.
+type accessFault struct {
+	Fault string `json:"fault"`
+	Delay string `json:"delay,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+// MakeAccessLog creates an AccessLog, opening its file.
+func MakeAccessLog(cfg *AccessLogConfig) (*AccessLog, error) {
+	format := cfg.Format
+	switch format {
+	case "":
+		format = AccessLogJSON
+	case AccessLogJSON, AccessLogLogfmt:
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+
+	// Open the file...
+	var w io.WriteCloser
+	if cfg.Path == "-" {
+		w = nopCloser{os.Stdout}
+	} else {
+		f, err := openRotatingFile(cfg.Path, int64(cfg.MaxSizeMB)<<20, cfg.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	return &AccessLog{format: format, w: w}, nil
+}
+
+// Observe writes the record for a completed request.
+func (a *AccessLog) Observe(l *RequestLog) {
+	rec := accessRecord{
+		Time:            l.Start,
+		Method:          l.Method,
+		URL:             l.URL,
+		ClientIP:        clientIP(l.ClientAddr),
+		Upstream:        l.Upstream,
+		Rule:            l.Rule,
+		Status:          l.Status,
+		BytesIn:         l.BytesIn,
+		BytesOut:        l.BytesOut,
+		UpstreamLatency: l.UpstreamLatency.String(),
+		AddedDelay:      l.AddedDelay().String(),
+		Duration:        l.Duration.String(),
+		Faults:          []accessFault{},
+	}
+	if l.Err != nil {
+		rec.Error = l.Err.Error()
+	}
+	var pre, post time.Duration
+	for _, d := range l.Decisions() {
+		switch d.Fault {
+		case FaultPreDelay:
+			pre += d.Delay
+		case FaultPostDelay:
+			post += d.Delay
+		}
+		f := accessFault{Fault: d.Fault, Value: d.Value}
+		if d.Delay > 0 {
+			f.Delay = d.Delay.String()
+		}
+		rec.Faults = append(rec.Faults, f)
+	}
+	rec.PreDelay = pre.String()
+	rec.PostDelay = post.String()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.format == AccessLogLogfmt {
+		writeLogfmt(a.w, &rec)
+		return
+	}
+	b, _ := json.Marshal(&rec)
+	a.w.Write(append(b, '\n'))
+}
+
+// Close closes the access log's file.
+func (a *AccessLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.w.Close()
+}
+
+// writeLogfmt writes rec as a logfmt line. Each fault is written as
+// "fault=<name>", followed by its delay and value, if it has them.
+func writeLogfmt(w io.Writer, rec *accessRecord) {
+	kvs := []interface{}{
+		"time", rec.Time.Format(time.RFC3339Nano),
+		"method", rec.Method,
+		"url", rec.URL,
+		"client_ip", rec.ClientIP,
+		"upstream", rec.Upstream,
+		"rule", rec.Rule,
+		"status", rec.Status,
+		"error", rec.Error,
+		"bytes_in", rec.BytesIn,
+		"bytes_out", rec.BytesOut,
+		"pre_delay", rec.PreDelay,
+		"upstream_latency", rec.UpstreamLatency,
+		"post_delay", rec.PostDelay,
+		"added_delay", rec.AddedDelay,
+		"duration", rec.Duration,
+	}
+	for _, d := range rec.Faults {
+		kvs = append(kvs, "fault", d.Fault)
+		if d.Delay != "" {
+			kvs = append(kvs, "fault_delay", d.Delay)
+		}
+		if d.Value != "" {
+			kvs = append(kvs, "fault_value", d.Value)
+		}
+	}
+	// Write the whole line at once, so it isn't split by a rotation...
+	b, _ := logfmt.MarshalKeyvals(kvs...)
+	w.Write(append(b, '\n'))
+}
+
+// clientIP returns the IP from a client's "host:port" address.
+func clientIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// rotatingFile is a file that's rotated once it reaches a maximum
+// size. Rotated files are renamed with a numeric suffix, with ".1"
+// being the most recent.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = fi.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) Close() error {
+	return r.f.Close()
+}
+
+// rotate shifts the existing backups along, moves the current file
+// to ".1" and opens a new file.
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+
+	// Find the last backup...
+	n := 1
+	for ; r.maxBackups == 0 || n < r.maxBackups; n++ {
+		if _, err := os.Stat(r.backup(n)); err != nil {
+			break
+		}
+	}
+
+	// ...and shift everything before it along one...
+	for i := n; i > 1; i-- {
+		if err := os.Rename(r.backup(i-1), r.backup(i)); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(r.path, r.backup(1)); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) backup(n int) string {
+	return fmt.Sprintf("%s.%d", r.path, n)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
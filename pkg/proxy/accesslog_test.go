@@ -0,0 +1,220 @@
+package proxy_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/a-poor/red-tape/pkg/proxy"
+	"github.com/go-logfmt/logfmt"
+)
+
+func TestAccessLog(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer up.Close()
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	a, err := proxy.MakeAccessLog(&proxy.AccessLogConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt, err := proxy.MakeRoundTripper(&proxy.ProxyConfig{
+		Faults:    proxy.Faults{PreDelayRate: 1, PreDelayMax: 1},
+		Observers: []proxy.Observer{a},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, up.URL+"/teapot", nil)
+	res, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(res.Body)
+	res.Body.Close()
+	a.Close()
+
+	// Read the record back...
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var rec struct {
+		Method string `json:"method"`
+		URL    string `json:"url"`
+		Status int    `json:"status"`
+		Faults []struct {
+			Fault string `json:"fault"`
+			Delay string `json:"delay"`
+		} `json:"faults"`
+	}
+	s := bufio.NewScanner(f)
+	if !s.Scan() {
+		t.Fatal("expected an access log record")
+	}
+	if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Method != http.MethodGet || rec.URL != up.URL+"/teapot" || rec.Status != http.StatusTeapot {
+		t.Fatalf("unexpected record %s", s.Bytes())
+	}
+	if len(rec.Faults) != 1 || rec.Faults[0].Fault != proxy.FaultPreDelay {
+		t.Fatalf("expected a pre-delay fault, got %s", s.Bytes())
+	}
+	if _, err := time.ParseDuration(rec.Faults[0].Delay); err != nil {
+		t.Fatalf("expected the sampled delay: %s", err)
+	}
+}
+
+func TestAccessLogLogfmt(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer up.Close()
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	a, err := proxy.MakeAccessLog(&proxy.AccessLogConfig{Path: path, Format: proxy.AccessLogLogfmt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt, err := proxy.MakeRoundTripper(&proxy.ProxyConfig{
+		Faults:    proxy.Faults{PreDelayRate: 1, PreDelayMax: 1},
+		Observers: []proxy.Observer{a},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, up.URL+"/teapot", nil)
+	res, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(res.Body)
+	res.Body.Close()
+	a.Close()
+
+	// Read the record back...
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	d := logfmt.NewDecoder(f)
+	if !d.ScanRecord() {
+		t.Fatal("expected an access log record")
+	}
+	rec := map[string]string{}
+	for d.ScanKeyval() {
+		rec[string(d.Key())] = string(d.Value())
+	}
+	if err := d.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if rec["method"] != http.MethodGet || rec["url"] != up.URL+"/teapot" || rec["status"] != "418" {
+		t.Fatalf("unexpected record %v", rec)
+	}
+	if rec["fault"] != proxy.FaultPreDelay {
+		t.Fatalf("expected a pre-delay fault, got %v", rec)
+	}
+	if _, err := time.ParseDuration(rec["fault_delay"]); err != nil {
+		t.Fatalf("expected the sampled delay: %s", err)
+	}
+	if d.ScanRecord() {
+		t.Fatal("expected a single access log record")
+	}
+}
+
+func TestAccessLogRotation(t *testing.T) {
+	for _, format := range []string{proxy.AccessLogJSON, proxy.AccessLogLogfmt} {
+		t.Run(format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "access.log")
+			a, err := proxy.MakeAccessLog(&proxy.AccessLogConfig{Path: path, Format: format, MaxSizeMB: 1, MaxBackups: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Write enough 20KB records to rotate the file a few times...
+			long := "http://upstream.test/" + strings.Repeat("x", 20<<10)
+			for i := 0; i < 175; i++ {
+				a.Observe(&proxy.RequestLog{Method: http.MethodGet, URL: fmt.Sprintf("%s?i=%d", long, i), Status: http.StatusOK})
+			}
+			a.Close()
+
+			// ...then only the backups to keep should be left, each
+			// under the maximum size and holding whole records, with
+			// the newest records in the current file.
+			if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+				t.Errorf("expected only 2 backups, got %v", err)
+			}
+			var last string
+			for _, p := range []string{path + ".2", path + ".1", path} {
+				fi, err := os.Stat(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if fi.Size() > 1<<20 {
+					t.Errorf("expected %s to be at most 1MB, got %d bytes", p, fi.Size())
+				}
+				urls, err := readAccessLogURLs(p, format)
+				if err != nil {
+					t.Fatalf("%s: %s", p, err)
+				}
+				if len(urls) == 0 {
+					t.Fatalf("expected records in %s", p)
+				}
+				last = urls[len(urls)-1]
+			}
+			if !strings.HasSuffix(last, "?i=174") {
+				t.Errorf("expected the last record to be the newest, got ...%s", last[len(last)-7:])
+			}
+		})
+	}
+}
+
+// readAccessLogURLs reads the URL of each record in an access log,
+// failing on records that aren't whole.
+func readAccessLogURLs(path, format string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var urls []string
+	if format == proxy.AccessLogLogfmt {
+		d := logfmt.NewDecoder(f)
+		for d.ScanRecord() {
+			rec := map[string]string{}
+			for d.ScanKeyval() {
+				rec[string(d.Key())] = string(d.Value())
+			}
+			if rec["method"] == "" || rec["url"] == "" || rec["duration"] == "" {
+				return nil, fmt.Errorf("partial record with %d keys", len(rec))
+			}
+			urls = append(urls, rec["url"])
+		}
+		return urls, d.Err()
+	}
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		var rec struct {
+			URL string `json:"url"`
+		}
+		if err := json.Unmarshal(s.Bytes(), &rec); err != nil {
+			return nil, err
+		}
+		urls = append(urls, rec.URL)
+	}
+	return urls, s.Err()
+}
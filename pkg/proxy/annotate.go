@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The headers (and trailers) added to responses when
+// ProxyConfig.AnnotateHeaders is set.
+const (
+	HeaderPreDelay    = "X-Red-Tape-Pre-Delay"
+	HeaderPostDelay   = "X-Red-Tape-Post-Delay"
+	HeaderFault       = "X-Red-Tape-Fault"
+	HeaderRule        = "X-Red-Tape-Rule"
+	HeaderStreamDelay = "X-Red-Tape-Stream-Delay"
+	HeaderStreamFault = "X-Red-Tape-Stream-Fault"
+	HeaderTotalDelay  = "X-Red-Tape-Added-Delay"
+)
+
+// The annotated values when no rule matched or no faults were injected.
+const (
+	annotatedRuleNone  = "default"
+	annotatedFaultNone = "none"
+)
+
+// annotateHeaders adds headers to res describing the faults injected
+// so far. For streamed responses, trailers are announced for the
+// faults injected while the body streams, and the returned function
+// fills them in once the body is done.
+func annotateHeaders(res *http.Response, l *RequestLog) func() {
+	rule := l.Rule
+	if rule == "" {
+		rule = annotatedRuleNone
+	}
+	decs := l.Decisions()
+	res.Header.Set(HeaderPreDelay, sumDelay(decs, FaultPreDelay).String())
+	res.Header.Set(HeaderPostDelay, sumDelay(decs, FaultPostDelay).String())
+	res.Header.Set(HeaderFault, faultNames(decs))
+	res.Header.Set(HeaderRule, rule)
+
+	// Trailers need a chunked response...
+	if res.ContentLength >= 0 {
+		return func() {}
+	}
+	if res.Trailer == nil {
+		res.Trailer = http.Header{}
+	}
+	for _, k := range []string{HeaderStreamDelay, HeaderStreamFault, HeaderTotalDelay} {
+		res.Trailer[k] = nil
+	}
+	n := len(decs)
+	return func() {
+		decs := l.Decisions()
+		var d time.Duration
+		for _, dec := range decs[n:] {
+			d += dec.Delay
+		}
+		res.Trailer.Set(HeaderStreamDelay, d.String())
+		res.Trailer.Set(HeaderStreamFault, faultNames(decs[n:]))
+		res.Trailer.Set(HeaderTotalDelay, l.AddedDelay().String())
+	}
+}
+
+// sumDelay returns the total delay for a type of fault.
+func sumDelay(decs []Decision, fault string) time.Duration {
+	var d time.Duration
+	for _, dec := range decs {
+		if dec.Fault == fault {
+			d += dec.Delay
+		}
+	}
+	return d
+}
+
+// faultNames returns a comma-separated list of the distinct faults
+// in decs, in the order they were first injected.
+func faultNames(decs []Decision) string {
+	var names []string
+	seen := map[string]bool{}
+	for _, d := range decs {
+		if !seen[d.Fault] {
+			seen[d.Fault] = true
+			names = append(names, d.Fault)
+		}
+	}
+	if len(names) == 0 {
+		return annotatedFaultNone
+	}
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,57 @@
+package proxy_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/a-poor/red-tape/pkg/proxy"
+)
+
+func TestAnnotateHeaders(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer up.Close()
+
+	p, err := proxy.MakeProxy(&proxy.ProxyConfig{
+		DestURL: up.URL,
+		Faults: proxy.Faults{
+			PreDelayRate: 1,
+			PreDelayMax:  1,
+			Stream:       &proxy.StreamConfig{ProbDropEvent: 1},
+		},
+		AnnotateHeaders: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(res.Body)
+	res.Body.Close()
+
+	if got := res.Header.Get(proxy.HeaderFault); got != "pre-delay" {
+		t.Errorf("expected fault header %q, got %q", "pre-delay", got)
+	}
+	if got := res.Header.Get(proxy.HeaderRule); got != "default" {
+		t.Errorf("expected rule header %q, got %q", "default", got)
+	}
+	if got := res.Header.Get(proxy.HeaderPostDelay); got != "0s" {
+		t.Errorf("expected post-delay header %q, got %q", "0s", got)
+	}
+	if got := res.Trailer.Get(proxy.HeaderStreamFault); got != "drop-event" {
+		t.Errorf("expected stream fault trailer %q, got %q", "drop-event", got)
+	}
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The request headers clients can set faults with, when
+// ClientFaultsConfig.Enabled is set.
+const (
+	HeaderClientDelay  = "X-Red-Tape-Delay"
+	HeaderClientStatus = "X-Red-Tape-Status"
+	HeaderClientDrop   = "X-Red-Tape-Drop"
+)
+
+// RuleClient is the rule name recorded for requests whose faults
+// were set with request headers.
+const RuleClient = "client-headers"
+
+// ClientFaultsConfig configures letting clients set the faults for
+// their own requests with request headers (e.g. "X-Red-Tape-Delay:
+// 500ms", "X-Red-Tape-Status: 503" or "X-Red-Tape-Drop: true").
+// The headers replace the configured faults for that request and
+// are never forwarded upstream.
+type ClientFaultsConfig struct {
+	// Read faults from request headers
+	Enabled bool `mapstructure:"enabled"`
+
+	// The client IPs or CIDRs allowed to set faults (empty allows any
+	// client). Headers from other clients are stripped and ignored.
+	AllowedCIDRs []string `mapstructure:"allowed-cidrs"`
+}
+
+// clientFaults are the faults a client set for a request.
+type clientFaults struct {
+	// A fixed delay before sending the request upstream
+	delay time.Duration
+
+	// A status to respond with instead of sending the request
+	status int
+
+	// Drop the request
+	drop bool
+}
+
+// clientFaultReader reads the faults set with request headers.
+type clientFaultReader struct {
+	enabled bool
+	allowed []*net.IPNet
+}
+
+func makeClientFaultReader(cfg *ClientFaultsConfig) (*clientFaultReader, error) {
+	cr := &clientFaultReader{enabled: cfg.Enabled}
+	for _, s := range cfg.AllowedCIDRs {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client faults cidr: %w", err)
+		}
+		cr.allowed = append(cr.allowed, n)
+	}
+	return cr, nil
+}
+
+// read returns the faults set in r's headers, if any, and a copy of
+// r with the headers removed. Headers from clients that aren't
+// allowed are removed without being read.
+func (cr *clientFaultReader) read(r *http.Request) (*clientFaults, *http.Request, error) {
+	if !cr.enabled {
+		return nil, r, nil
+	}
+	delay := r.Header.Get(HeaderClientDelay)
+	status := r.Header.Get(HeaderClientStatus)
+	drop := r.Header.Get(HeaderClientDrop)
+	if delay == "" && status == "" && drop == "" {
+		return nil, r, nil
+	}
+
+	// Strip the headers...
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Header = r.Header.Clone()
+	for _, k := range []string{HeaderClientDelay, HeaderClientStatus, HeaderClientDrop} {
+		r2.Header.Del(k)
+	}
+	if !cr.allows(r.RemoteAddr) {
+		return nil, r2, nil
+	}
+
+	// ...and parse them...
+	cf := &clientFaults{}
+	if delay != "" {
+		d, err := time.ParseDuration(delay)
+		if err != nil || d < 0 {
+			return nil, nil, fmt.Errorf("invalid %s header %q", HeaderClientDelay, delay)
+		}
+		cf.delay = d
+	}
+	if status != "" {
+		s, err := strconv.Atoi(status)
+		if err != nil || s < 100 || s > 599 {
+			return nil, nil, fmt.Errorf("invalid %s header %q", HeaderClientStatus, status)
+		}
+		cf.status = s
+	}
+	if drop != "" {
+		b, err := strconv.ParseBool(drop)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid %s header %q", HeaderClientDrop, drop)
+		}
+		cf.drop = b
+	}
+	return cf, r2, nil
+}
+
+// allows returns true if the client at addr may set faults.
+func (cr *clientFaultReader) allows(addr string) bool {
+	if len(cr.allowed) == 0 {
+		return true
+	}
+	ip := net.ParseIP(clientIP(addr))
+	if ip == nil {
+		return false
+	}
+	for _, n := range cr.allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
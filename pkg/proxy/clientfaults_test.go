@@ -0,0 +1,124 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/a-poor/red-tape/pkg/proxy"
+)
+
+func TestClientFaultHeaders(t *testing.T) {
+	var got http.Header
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+	}))
+	defer up.Close()
+
+	p, err := proxy.MakeProxy(&proxy.ProxyConfig{
+		DestURL:      up.URL,
+		ClientFaults: proxy.ClientFaultsConfig{Enabled: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	// A delay is applied and the header isn't forwarded...
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set(proxy.HeaderClientDelay, "50ms")
+	start := time.Now()
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("expected a delay of at least 50ms, took %s", d)
+	}
+	if got.Get(proxy.HeaderClientDelay) != "" {
+		t.Errorf("expected %s to be stripped", proxy.HeaderClientDelay)
+	}
+
+	// ...a status is returned without calling the upstream...
+	got = nil
+	req, _ = http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set(proxy.HeaderClientStatus, "503")
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503, got %d", res.StatusCode)
+	}
+	if got != nil {
+		t.Error("expected the upstream not to be called")
+	}
+
+	// ...and the request can be dropped...
+	req, _ = http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set(proxy.HeaderClientDrop, "true")
+	if _, err := http.DefaultClient.Do(req); err == nil {
+		t.Error("expected the request to be dropped")
+	}
+}
+
+func TestClientFaultHeadersNotAllowed(t *testing.T) {
+	var got http.Header
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header
+	}))
+	defer up.Close()
+
+	p, err := proxy.MakeProxy(&proxy.ProxyConfig{
+		DestURL: up.URL,
+		ClientFaults: proxy.ClientFaultsConfig{
+			Enabled:      true,
+			AllowedCIDRs: []string{"10.0.0.0/8"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set(proxy.HeaderClientStatus, "503")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", res.StatusCode)
+	}
+	if got.Get(proxy.HeaderClientStatus) != "" {
+		t.Errorf("expected %s to be stripped", proxy.HeaderClientStatus)
+	}
+}
+
+func TestProbError(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+
+	rt, err := proxy.MakeRoundTripper(&proxy.ProxyConfig{
+		DestURL: up.URL,
+		Faults:  proxy.Faults{ProbError: 1, ErrorStatus: http.StatusTooManyRequests},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, up.URL, nil)
+	res, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected status 429, got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"golang.org/x/exp/rand"
+)
+
+// Dialer dials connections with the proxy's faults injected, for
+// proxy modes that tunnel raw connections (like CONNECT tunnels).
+// The pre-delay is added before dialing and the post-delay is added
+// before the first bytes are read back from the destination.
+type Dialer struct {
+	cfg    *ProxyConfig
+	src    rand.Source
+	logger log.Logger
+	dialer net.Dialer
+}
+
+// MakeDialer creates a Dialer using cfg's fault settings and rules.
+func MakeDialer(cfg *ProxyConfig) *Dialer {
+	return &Dialer{
+		cfg:    cfg,
+		src:    newSource(cfg.Seed),
+		logger: cfg.logger(),
+	}
+}
+
+// DialContext connects to addr, injecting the faults for the rule
+// matching it.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	// Find the faults for the destination...
+	rule, f := d.cfg.match(splitAddr(addr))
+
+	// Sleep before...
+	delay := sampleDelay(d.src, f.PreDelayRate, f.PreDelayMax)
+	d.logger.Debug("Sleeping before dialing.", "addr", addr, "rule", rule, "delay", delay)
+	if err := sleepContext(ctx, delay); err != nil {
+		return nil, err
+	}
+
+	// Should the connection be dropped?
+	if sampleProb(d.src, f.ProbDrop) {
+		d.logger.Debug("Dropping connection.", "addr", addr, "rule", rule)
+		return nil, ErrDropped
+	}
+
+	// Dial the destination...
+	c, err := d.dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &faultConn{
+		Conn:      c,
+		postDelay: sampleDelay(d.src, f.PostDelayRate, f.PostDelayMax),
+	}, nil
+}
+
+// faultConn is a connection that sleeps before its first read.
+type faultConn struct {
+	net.Conn
+	postDelay time.Duration
+	once      sync.Once
+}
+
+func (c *faultConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.once.Do(func() {
+		time.Sleep(c.postDelay)
+	})
+	return n, err
+}
+
+// CloseWrite half-closes the connection, if it supports it.
+func (c *faultConn) CloseWrite() error {
+	return closeWrite(c.Conn)
+}
+
+// sleepContext sleeps for d or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
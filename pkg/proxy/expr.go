@@ -0,0 +1,681 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ExprBodyBytes is how much of a request's body expressions can read,
+// as the body variable.
+const ExprBodyBytes = 4096
+
+// exprType is the type of an expression's value.
+type exprType int
+
+const (
+	exprBool exprType = iota
+	exprNumber
+	exprString
+)
+
+func (t exprType) String() string {
+	switch t {
+	case exprBool:
+		return "bool"
+	case exprNumber:
+		return "number"
+	default:
+		return "string"
+	}
+}
+
+// expr is a compiled rule expression. Expressions are type checked
+// when they're compiled, so evaluating them can't fail.
+//
+// They can use the variables:
+//
+//	method   the request's method
+//	host     the request's host
+//	path     the request's path
+//	body     up to ExprBodyBytes of the request's body
+//	count    the number of requests received so far, including this one
+//	elapsed  the seconds since the proxy started
+//
+// the functions:
+//
+//	header(name)       the value of a request header
+//	query(name)        the value of a query parameter
+//	counter(key)       the number of requests that have counted key,
+//	                   including this one
+//	contains(s, sub)   whether s contains sub
+//	hasPrefix(s, p)    whether s starts with p
+//	hasSuffix(s, p)    whether s ends with p
+//	matches(s, re)     whether s matches the regexp re (a literal)
+//	lower(s)           s in lower case
+//	len(s)             the length of s
+//
+// and the operators (from the lowest precedence) "c ? a : b", "||",
+// "&&", "==" and "!=", "<", "<=", ">" and ">=", "+" and "-", "*", "/"
+// and "%", and the unary "!" and "-". Strings are quoted with double
+// or single quotes, and "+" joins them.
+type expr struct {
+	node exprNode
+	body bool // Whether it reads the request body
+}
+
+// compileExpr compiles an expression, checking it has the type want.
+func compileExpr(src string, want exprType) (*expr, error) {
+	toks, err := lexExpr(src)
+	if err != nil {
+		return nil, fmt.Errorf("expression %q: %w", src, err)
+	}
+	p := &exprParser{toks: toks}
+	n, t, err := p.parseCond()
+	if err == nil && p.peek().kind != tokEOF {
+		err = p.errorf("unexpected %q", p.peek().text)
+	}
+	if err == nil && t != want {
+		err = fmt.Errorf("expected a %s, got a %s", want, t)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("expression %q: %w", src, err)
+	}
+	return &expr{node: n, body: p.body}, nil
+}
+
+func (e *expr) evalBool(env *exprEnv) bool {
+	return e.node.eval(env).(bool)
+}
+
+func (e *expr) evalNumber(env *exprEnv) float64 {
+	return e.node.eval(env).(float64)
+}
+
+// exprState is shared by the expressions evaluated for a proxy's
+// requests.
+type exprState struct {
+	start time.Time
+	body  bool // Whether to read request bodies
+	count int64
+
+	mu   sync.Mutex
+	keys map[string]float64
+}
+
+func newExprState(body bool) *exprState {
+	return &exprState{start: time.Now(), body: body, keys: map[string]float64{}}
+}
+
+// env counts a request and returns the environment expressions are
+// evaluated in for it. If the expressions read the body, the start
+// of it is read and a copy of r is returned with a body that can
+// still be sent.
+func (s *exprState) env(r *http.Request) (*exprEnv, *http.Request) {
+	if s.body && r.Body != nil && r.Body != http.NoBody {
+		b, _ := io.ReadAll(io.LimitReader(r.Body, ExprBodyBytes))
+		body := r.Body
+		r = r.WithContext(r.Context())
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(b), body), body}
+		return s.newEnv(r, string(b)), r
+	}
+	return s.newEnv(r, ""), r
+}
+
+func (s *exprState) newEnv(r *http.Request, body string) *exprEnv {
+	return &exprEnv{
+		r:       r,
+		count:   float64(atomic.AddInt64(&s.count, 1)),
+		elapsed: time.Since(s.start).Seconds(),
+		body:    body,
+		state:   s,
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// exprEnv is the environment an expression is evaluated in.
+type exprEnv struct {
+	r       *http.Request
+	body    string
+	count   float64
+	elapsed float64
+	state   *exprState
+	counted map[string]float64
+}
+
+// counter counts the request for key (once, however many times it's
+// called) and returns the count.
+func (env *exprEnv) counter(key string) float64 {
+	if n, ok := env.counted[key]; ok {
+		return n
+	}
+	env.state.mu.Lock()
+	env.state.keys[key]++
+	n := env.state.keys[key]
+	env.state.mu.Unlock()
+	if env.counted == nil {
+		env.counted = map[string]float64{}
+	}
+	env.counted[key] = n
+	return n
+}
+
+// The kinds of token in an expression.
+const (
+	tokEOF = iota
+	tokNumber
+	tokString
+	tokIdent
+	tokOp
+)
+
+type exprToken struct {
+	kind int
+	text string
+	num  float64
+	str  string
+	pos  int
+}
+
+// exprOps are the operators, longest first.
+var exprOps = []string{"||", "&&", "==", "!=", "<=", ">=", "<", ">", "+", "-", "*", "/", "%", "!", "(", ")", ",", "?", ":"}
+
+// lexExpr splits an expression into tokens.
+func lexExpr(src string) ([]exprToken, error) {
+	var toks []exprToken
+	i := 0
+	for i < len(src) {
+		c := rune(src[i])
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c >= '0' && c <= '9' || c == '.':
+			j := i
+			for j < len(src) && (src[j] >= '0' && src[j] <= '9' || src[j] == '.') {
+				j++
+			}
+			n, err := strconv.ParseFloat(src[i:j], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q at position %d", src[i:j], i)
+			}
+			toks = append(toks, exprToken{kind: tokNumber, text: src[i:j], num: n, pos: i})
+			i = j
+		case c == '"' || c == '\'':
+			j := i + 1
+			var sb strings.Builder
+			for ; j < len(src) && src[j] != src[i]; j++ {
+				if src[j] == '\\' && j+1 < len(src) {
+					j++
+					switch src[j] {
+					case 'n':
+						sb.WriteByte('\n')
+					case 't':
+						sb.WriteByte('\t')
+					default:
+						sb.WriteByte(src[j])
+					}
+					continue
+				}
+				sb.WriteByte(src[j])
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string at position %d", i)
+			}
+			toks = append(toks, exprToken{kind: tokString, text: src[i : j+1], str: sb.String(), pos: i})
+			i = j + 1
+		case isIdentByte(src[i]) && !(c >= '0' && c <= '9'):
+			j := i
+			for j < len(src) && isIdentByte(src[j]) {
+				j++
+			}
+			toks = append(toks, exprToken{kind: tokIdent, text: src[i:j], pos: i})
+			i = j
+		default:
+			op := ""
+			for _, o := range exprOps {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at position %d", c, i)
+			}
+			toks = append(toks, exprToken{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(toks, exprToken{kind: tokEOF, text: "end of expression", pos: len(src)}), nil
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// exprParser parses tokens into a typed syntax tree.
+type exprParser struct {
+	toks []exprToken
+	pos  int
+	body bool
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.toks[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it's one of the operators.
+func (p *exprParser) accept(ops ...string) (string, bool) {
+	t := p.peek()
+	if t.kind != tokOp {
+		return "", false
+	}
+	for _, o := range ops {
+		if t.text == o {
+			p.pos++
+			return o, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) expect(op string) error {
+	if _, ok := p.accept(op); !ok {
+		return p.errorf("expected %q, got %q", op, p.peek().text)
+	}
+	return nil
+}
+
+func (p *exprParser) errorf(format string, args ...any) error {
+	return fmt.Errorf(format+" at position %d", append(args, p.peek().pos)...)
+}
+
+func (p *exprParser) parseCond() (exprNode, exprType, error) {
+	c, ct, err := p.parseBinary(0)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, ok := p.accept("?"); !ok {
+		return c, ct, nil
+	}
+	if ct != exprBool {
+		return nil, 0, p.errorf("the condition of \"?\" must be a bool, not a %s", ct)
+	}
+	a, at, err := p.parseCond()
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, 0, err
+	}
+	b, bt, err := p.parseCond()
+	if err != nil {
+		return nil, 0, err
+	}
+	if at != bt {
+		return nil, 0, p.errorf("the results of \"?\" must have the same type, not %s and %s", at, bt)
+	}
+	return condNode{c, a, b}, at, nil
+}
+
+// exprLevels are the binary operators, from the lowest precedence.
+var exprLevels = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (p *exprParser) parseBinary(level int) (exprNode, exprType, error) {
+	if level == len(exprLevels) {
+		return p.parseUnary()
+	}
+	x, xt, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	for {
+		op, ok := p.accept(exprLevels[level]...)
+		if !ok {
+			return x, xt, nil
+		}
+		y, yt, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		t, err := binaryType(op, xt, yt)
+		if err != nil {
+			return nil, 0, p.errorf("%s", err)
+		}
+		x, xt = binaryNode{op: op, x: x, y: y}, t
+	}
+}
+
+// binaryType returns the type of a binary operator's result.
+func binaryType(op string, x, y exprType) (exprType, error) {
+	if x != y {
+		return 0, fmt.Errorf("can't use %q with a %s and a %s", op, x, y)
+	}
+	switch op {
+	case "||", "&&":
+		if x == exprBool {
+			return exprBool, nil
+		}
+	case "==", "!=":
+		return exprBool, nil
+	case "<", "<=", ">", ">=":
+		if x != exprBool {
+			return exprBool, nil
+		}
+	case "+":
+		if x != exprBool {
+			return x, nil
+		}
+	default:
+		if x == exprNumber {
+			return exprNumber, nil
+		}
+	}
+	return 0, fmt.Errorf("can't use %q with a %s", op, x)
+}
+
+func (p *exprParser) parseUnary() (exprNode, exprType, error) {
+	op, ok := p.accept("!", "-")
+	if !ok {
+		return p.parsePrimary()
+	}
+	x, t, err := p.parseUnary()
+	if err != nil {
+		return nil, 0, err
+	}
+	if op == "!" && t != exprBool || op == "-" && t != exprNumber {
+		return nil, 0, p.errorf("can't use %q with a %s", op, t)
+	}
+	return unaryNode{op, x}, t, nil
+}
+
+func (p *exprParser) parsePrimary() (exprNode, exprType, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNumber:
+		return litNode{t.num}, exprNumber, nil
+	case tokString:
+		return litNode{t.str}, exprString, nil
+	case tokOp:
+		if t.text != "(" {
+			break
+		}
+		x, xt, err := p.parseCond()
+		if err != nil {
+			return nil, 0, err
+		}
+		return x, xt, p.expect(")")
+	case tokIdent:
+		if _, ok := p.accept("("); ok {
+			return p.parseCall(t)
+		}
+		switch t.text {
+		case "true", "false":
+			return litNode{t.text == "true"}, exprBool, nil
+		case "body":
+			p.body = true
+		}
+		typ, ok := exprVars[t.text]
+		if !ok {
+			return nil, 0, fmt.Errorf("unknown variable %q at position %d", t.text, t.pos)
+		}
+		return varNode(t.text), typ, nil
+	}
+	return nil, 0, fmt.Errorf("unexpected %q at position %d", t.text, t.pos)
+}
+
+func (p *exprParser) parseCall(name exprToken) (exprNode, exprType, error) {
+	// Parse the arguments...
+	var args []exprNode
+	var types []exprType
+	if _, ok := p.accept(")"); !ok {
+		for {
+			a, at, err := p.parseCond()
+			if err != nil {
+				return nil, 0, err
+			}
+			args = append(args, a)
+			types = append(types, at)
+			if _, ok := p.accept(","); !ok {
+				break
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	// ...and check them against the function's...
+	fn, ok := exprFuncs[name.text]
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown function %q at position %d", name.text, name.pos)
+	}
+	if len(args) != len(fn.args) {
+		return nil, 0, fmt.Errorf("%s takes %d arguments, not %d", name.text, len(fn.args), len(args))
+	}
+	for i, t := range types {
+		if t != fn.args[i] {
+			return nil, 0, fmt.Errorf("argument %d of %s must be a %s, not a %s", i+1, name.text, fn.args[i], t)
+		}
+	}
+
+	// The regexp for matches is compiled now...
+	if name.text == "matches" {
+		lit, ok := args[1].(litNode)
+		if !ok {
+			return nil, 0, fmt.Errorf("the regexp for matches must be a string literal")
+		}
+		re, err := regexp.Compile(lit.v.(string))
+		if err != nil {
+			return nil, 0, err
+		}
+		return matchNode{args[0], re}, exprBool, nil
+	}
+	return callNode{fn.fn, args}, fn.ret, nil
+}
+
+// exprVars are the variables expressions can use, and their types.
+var exprVars = map[string]exprType{
+	"method":  exprString,
+	"host":    exprString,
+	"path":    exprString,
+	"body":    exprString,
+	"count":   exprNumber,
+	"elapsed": exprNumber,
+}
+
+// exprFunc is a function expressions can call.
+type exprFunc struct {
+	args []exprType
+	ret  exprType
+	fn   func(env *exprEnv, args []any) any
+}
+
+// exprFuncs are the functions expressions can call.
+var exprFuncs = map[string]exprFunc{
+	"header": {[]exprType{exprString}, exprString, func(env *exprEnv, a []any) any {
+		return env.r.Header.Get(a[0].(string))
+	}},
+	"query": {[]exprType{exprString}, exprString, func(env *exprEnv, a []any) any {
+		return env.r.URL.Query().Get(a[0].(string))
+	}},
+	"counter": {[]exprType{exprString}, exprNumber, func(env *exprEnv, a []any) any {
+		return env.counter(a[0].(string))
+	}},
+	"contains": {[]exprType{exprString, exprString}, exprBool, func(_ *exprEnv, a []any) any {
+		return strings.Contains(a[0].(string), a[1].(string))
+	}},
+	"hasPrefix": {[]exprType{exprString, exprString}, exprBool, func(_ *exprEnv, a []any) any {
+		return strings.HasPrefix(a[0].(string), a[1].(string))
+	}},
+	"hasSuffix": {[]exprType{exprString, exprString}, exprBool, func(_ *exprEnv, a []any) any {
+		return strings.HasSuffix(a[0].(string), a[1].(string))
+	}},
+	"matches": {[]exprType{exprString, exprString}, exprBool, nil},
+	"lower": {[]exprType{exprString}, exprString, func(_ *exprEnv, a []any) any {
+		return strings.ToLower(a[0].(string))
+	}},
+	"len": {[]exprType{exprString}, exprNumber, func(_ *exprEnv, a []any) any {
+		return float64(len(a[0].(string)))
+	}},
+}
+
+// exprNode is a node of an expression's syntax tree.
+type exprNode interface {
+	eval(env *exprEnv) any
+}
+
+type litNode struct{ v any }
+
+func (n litNode) eval(*exprEnv) any { return n.v }
+
+type varNode string
+
+func (n varNode) eval(env *exprEnv) any {
+	switch n {
+	case "method":
+		return env.r.Method
+	case "host":
+		return env.r.URL.Hostname()
+	case "path":
+		return env.r.URL.Path
+	case "body":
+		return env.body
+	case "count":
+		return env.count
+	default:
+		return env.elapsed
+	}
+}
+
+type unaryNode struct {
+	op string
+	x  exprNode
+}
+
+func (n unaryNode) eval(env *exprEnv) any {
+	if n.op == "!" {
+		return !n.x.eval(env).(bool)
+	}
+	return -n.x.eval(env).(float64)
+}
+
+type binaryNode struct {
+	op   string
+	x, y exprNode
+}
+
+func (n binaryNode) eval(env *exprEnv) any {
+	// Short-circuit the logical operators...
+	x := n.x.eval(env)
+	switch n.op {
+	case "||":
+		return x.(bool) || n.y.eval(env).(bool)
+	case "&&":
+		return x.(bool) && n.y.eval(env).(bool)
+	}
+	y := n.y.eval(env)
+	switch n.op {
+	case "==":
+		return x == y
+	case "!=":
+		return x != y
+	}
+
+	// ...otherwise the operands are both numbers or both strings.
+	if xs, ok := x.(string); ok {
+		ys := y.(string)
+		switch n.op {
+		case "<":
+			return xs < ys
+		case "<=":
+			return xs <= ys
+		case ">":
+			return xs > ys
+		case ">=":
+			return xs >= ys
+		default:
+			return xs + ys
+		}
+	}
+	xf, yf := x.(float64), y.(float64)
+	switch n.op {
+	case "<":
+		return xf < yf
+	case "<=":
+		return xf <= yf
+	case ">":
+		return xf > yf
+	case ">=":
+		return xf >= yf
+	case "+":
+		return xf + yf
+	case "-":
+		return xf - yf
+	case "*":
+		return xf * yf
+	case "/":
+		return xf / yf
+	default:
+		return math.Mod(xf, yf)
+	}
+}
+
+type condNode struct {
+	c, a, b exprNode
+}
+
+func (n condNode) eval(env *exprEnv) any {
+	if n.c.eval(env).(bool) {
+		return n.a.eval(env)
+	}
+	return n.b.eval(env)
+}
+
+type callNode struct {
+	fn   func(env *exprEnv, args []any) any
+	args []exprNode
+}
+
+func (n callNode) eval(env *exprEnv) any {
+	args := make([]any, len(n.args))
+	for i, a := range n.args {
+		args[i] = a.eval(env)
+	}
+	return n.fn(env, args)
+}
+
+type matchNode struct {
+	x  exprNode
+	re *regexp.Regexp
+}
+
+func (n matchNode) eval(env *exprEnv) any {
+	return n.re.MatchString(n.x.eval(env).(string))
+}
@@ -0,0 +1,146 @@
+package proxy_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/a-poor/red-tape/pkg/proxy"
+)
+
+func TestRuleExprValidate(t *testing.T) {
+	tests := []struct {
+		rule proxy.Rule
+		ok   bool
+	}{
+		{proxy.Rule{When: `method == "GET" && !contains(path, "/health")`}, true},
+		{proxy.Rule{When: `counter(header('X-User')) % 3 == 0 || elapsed > 60`}, true},
+		{proxy.Rule{When: `matches(lower(body), "priority.?:.?low")`}, true},
+		{proxy.Rule{Params: map[string]string{"pre-delay-max": `len(body) > 100 ? count * 2 : -1`}}, true},
+		{proxy.Rule{When: `path`}, false},
+		{proxy.Rule{When: `method == 1`}, false},
+		{proxy.Rule{When: `nope == "x"`}, false},
+		{proxy.Rule{When: `header()`}, false},
+		{proxy.Rule{When: `matches(path, path)`}, false},
+		{proxy.Rule{When: `contains(path, "x"`}, false},
+		{proxy.Rule{When: `"unterminated`}, false},
+		{proxy.Rule{Params: map[string]string{"prob-error": `true`}}, false},
+		{proxy.Rule{Params: map[string]string{"nope": `1`}}, false},
+	}
+	for _, tt := range tests {
+		cfg := &proxy.ProxyConfig{Rules: []proxy.Rule{tt.rule}}
+		if err := cfg.Validate(); (err == nil) != tt.ok {
+			t.Errorf("%q %v: unexpected error %v", tt.rule.When, tt.rule.Params, err)
+		}
+	}
+}
+
+func TestRuleExprs(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.Write(b)
+	}))
+	defer up.Close()
+
+	rt, err := proxy.MakeRoundTripper(&proxy.ProxyConfig{
+		Rules: []proxy.Rule{
+			{
+				Name:   "every-third",
+				When:   `header("X-User") == "x" && counter("x") % 3 == 0`,
+				Params: map[string]string{"error-status": `400 + counter("x") / 3`},
+				Faults: proxy.Faults{ProbError: 1},
+			},
+			{
+				Name:   "low-priority",
+				When:   `contains(body, '"priority":"low"')`,
+				Faults: proxy.Faults{ProbError: 1, ErrorStatus: http.StatusTooManyRequests},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(user, body string) (int, string) {
+		req, _ := http.NewRequest(http.MethodPost, up.URL, strings.NewReader(body))
+		req.Header.Set("X-User", user)
+		res, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(b)
+	}
+
+	// Every third request from x fails...
+	var got []int
+	for i := 0; i < 6; i++ {
+		send("y", "")
+		status, _ := send("x", "")
+		got = append(got, status)
+	}
+	want := []int{200, 200, 401, 200, 200, 402}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected statuses %v, got %v", want, got)
+		}
+	}
+
+	// ...and low priority requests are rejected, while the body is
+	// still sent upstream for the others.
+	if status, _ := send("", `{"priority":"low"}`); status != http.StatusTooManyRequests {
+		t.Errorf("expected status 429, got %d", status)
+	}
+	if status, body := send("", `{"priority":"high"}`); status != http.StatusOK || body != `{"priority":"high"}` {
+		t.Errorf("unexpected response %d %q", status, body)
+	}
+}
+
+func TestRuleExprParamLimits(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+
+	tests := []struct {
+		params map[string]string
+		status int
+	}{
+		// Invalid statuses fall back to the rule's...
+		{map[string]string{"prob-error": "1", "error-status": "count * 1000"}, http.StatusTeapot},
+		{map[string]string{"prob-error": "1", "error-status": "1 / 0"}, http.StatusTeapot},
+		{map[string]string{"prob-error": "1", "error-status": "0 - 5"}, http.StatusTeapot},
+		{map[string]string{"prob-error": "1", "error-status": "0 / 0"}, http.StatusTeapot},
+		{map[string]string{"prob-error": "1", "error-status": "429"}, http.StatusTooManyRequests},
+
+		// ...probabilities are clamped or ignored...
+		{map[string]string{"prob-error": "5"}, http.StatusTeapot},
+		{map[string]string{"prob-error": "0 / 0", "prob-drop": "0 - 1"}, http.StatusOK},
+
+		// ...and negative delays are clamped to 0.
+		{map[string]string{"pre-delay-rate": "0 - 1", "pre-delay-max": "0 - 100"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		p, err := proxy.MakeProxy(&proxy.ProxyConfig{
+			DestURL: up.URL,
+			Rules: []proxy.Rule{{
+				Params: tt.params,
+				Faults: proxy.Faults{ErrorStatus: http.StatusTeapot},
+			}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := httptest.NewServer(p)
+		res, err := http.Get(srv.URL)
+		srv.Close()
+		if err != nil {
+			t.Fatalf("%v: %v", tt.params, err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tt.status {
+			t.Errorf("%v: expected status %d, got %d", tt.params, tt.status, res.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"golang.org/x/exp/rand"
+)
+
+// Fault is a step of the fault pipeline the round tripper runs for
+// each request. Embed NopFault to implement only some of the hooks.
+type Fault interface {
+	// BeforeRequest runs before the request is sent upstream, in
+	// pipeline order. Returning a response or an error ends the
+	// request early: the later faults' BeforeRequest hooks are
+	// skipped and the request isn't sent. A returned response is
+	// still passed through WrapBody and AfterResponse.
+	BeforeRequest(fc *FaultContext, r *http.Request) (*http.Response, error)
+
+	// WrapBody can wrap the response body, before it's returned to
+	// the client. It runs in pipeline order, so later faults wrap
+	// the bodies returned by earlier ones.
+	WrapBody(fc *FaultContext, res *http.Response, body io.ReadCloser) io.ReadCloser
+
+	// AfterResponse runs once the response headers have been
+	// received, in pipeline order, before the response is returned
+	// to the client.
+	AfterResponse(fc *FaultContext, res *http.Response)
+}
+
+// NopFault implements Fault with hooks that do nothing.
+type NopFault struct{}
+
+func (NopFault) BeforeRequest(*FaultContext, *http.Request) (*http.Response, error) {
+	return nil, nil
+}
+
+func (NopFault) WrapBody(_ *FaultContext, _ *http.Response, body io.ReadCloser) io.ReadCloser {
+	return body
+}
+
+func (NopFault) AfterResponse(*FaultContext, *http.Response) {}
+
+// FaultContext is shared by the faults in the pipeline for a single
+// request.
+type FaultContext struct {
+	// The fault settings for the request, from the matching rule,
+	// the live faults or the defaults
+	Faults *Faults
+
+	// The name of the matching rule (empty for the defaults)
+	Rule string
+
+	// The request's log, recording the faults injected into it
+	Log *RequestLog
+
+	// The proxy's logger
+	Logger log.Logger
+
+	// The proxy's random number generator (seeded with
+	// ProxyConfig.Seed)
+	Rand *rand.Rand
+
+	src      rand.Source
+	client   *clientFaults
+	inFlight *int64
+}
+
+// Decide records a fault decision in the request's log.
+func (fc *FaultContext) Decide(d Decision) {
+	fc.Log.decide(d)
+}
+
+// Sleep records a delay fault and sleeps for it, recording the time
+// as a phase of the request.
+func (fc *FaultContext) Sleep(fault, phase string, d time.Duration) {
+	fc.Log.delay(fault, d)
+	fc.Log.sleep(phase, d)
+}
+
+// SampleDelay samples a delay from an exponential distribution with
+// the given rate (1/ms), clamped to max (ms).
+func (fc *FaultContext) SampleDelay(rate, max float64) time.Duration {
+	return sampleDelay(fc.src, rate, max)
+}
+
+// SampleProb returns true with probability p.
+func (fc *FaultContext) SampleProb(p float64) bool {
+	return sampleProb(fc.src, p)
+}
+
+// Pipeline is an ordered list of faults.
+type Pipeline []Fault
+
+// DefaultPipeline returns the built-in faults, in the order they're
+// run by default: the pre-delay, the load delay, drops, network
+// errors, error statuses, redirects, header mutations, JSON
+// mutations, stream faults and the post-delay.
+func DefaultPipeline() Pipeline {
+	return Pipeline{
+		preDelayFault{},
+		loadDelayFault{},
+		dropFault{},
+		netErrorFault{},
+		errorStatusFault{},
+		redirectFault{},
+		headerFault{},
+		jsonFault{},
+		streamFault{},
+		postDelayFault{},
+	}
+}
+
+// beforeRequest runs each fault's BeforeRequest hook until one ends
+// the request.
+func (p Pipeline) beforeRequest(fc *FaultContext, r *http.Request) (*http.Response, error) {
+	for _, f := range p {
+		if res, err := f.BeforeRequest(fc, r); res != nil || err != nil {
+			return res, err
+		}
+	}
+	return nil, nil
+}
+
+// afterResponse wraps the response body with each fault and then
+// runs each fault's AfterResponse hook.
+func (p Pipeline) afterResponse(fc *FaultContext, res *http.Response) {
+	for _, f := range p {
+		res.Body = f.WrapBody(fc, res, res.Body)
+	}
+	for _, f := range p {
+		f.AfterResponse(fc, res)
+	}
+}
+
+// preDelayFault sleeps before the request is sent.
+type preDelayFault struct{ NopFault }
+
+func (preDelayFault) BeforeRequest(fc *FaultContext, r *http.Request) (*http.Response, error) {
+	d := fc.SampleDelay(fc.Faults.PreDelayRate, fc.Faults.PreDelayMax) + fc.client.delay
+	fc.Logger.Debug("Sleeping before request.", "delay", d)
+	fc.Sleep(FaultPreDelay, PhasePreDelay, d)
+	return nil, nil
+}
+
+// loadDelayFault sleeps for longer the more requests are in flight.
+type loadDelayFault struct{ NopFault }
+
+func (loadDelayFault) BeforeRequest(fc *FaultContext, r *http.Request) (*http.Response, error) {
+	if fc.Faults.Load == nil {
+		return nil, nil
+	}
+	n := atomic.LoadInt64(fc.inFlight) - 1
+	d := fc.Faults.Load.delay(n)
+	fc.Logger.Debug("Sleeping for load.", "in_flight", n, "delay", d)
+	fc.Sleep(FaultLoadDelay, PhaseLoadDelay, d)
+	return nil, nil
+}
+
+// dropFault drops requests.
+type dropFault struct{ NopFault }
+
+func (dropFault) BeforeRequest(fc *FaultContext, r *http.Request) (*http.Response, error) {
+	if !fc.client.drop && !fc.SampleProb(fc.Faults.ProbDrop) {
+		return nil, nil
+	}
+	fc.Logger.Debug("Dropping request.", "rule", fc.Rule)
+	fc.Decide(Decision{Fault: FaultDrop})
+	return nil, ErrDropped
+}
+
+// netErrorFault fails requests with network errors.
+type netErrorFault struct{ NopFault }
+
+func (netErrorFault) BeforeRequest(fc *FaultContext, r *http.Request) (*http.Response, error) {
+	if !fc.SampleProb(fc.Faults.ProbNetError) {
+		return nil, nil
+	}
+	kind := pickNetError(fc.src, fc.Faults.NetErrors)
+	fc.Logger.Debug("Failing request with network error.", "rule", fc.Rule, "kind", kind)
+	fc.Decide(Decision{Fault: FaultNetError, Value: kind})
+	return nil, netError(kind, r.URL.Hostname())
+}
+
+// errorStatusFault responds with error statuses.
+type errorStatusFault struct{ NopFault }
+
+func (errorStatusFault) BeforeRequest(fc *FaultContext, r *http.Request) (*http.Response, error) {
+	status := fc.client.status
+	if status == 0 && fc.SampleProb(fc.Faults.ProbError) {
+		status = fc.Faults.errorStatus()
+	}
+	if status == 0 {
+		return nil, nil
+	}
+	fc.Logger.Debug("Responding with error.", "rule", fc.Rule, "status", status)
+	fc.Decide(Decision{Fault: FaultError, Value: strconv.Itoa(status)})
+	return makeResponse(r, status, http.StatusText(status)), nil
+}
+
+// streamFault injects faults into streamed responses.
+type streamFault struct{ NopFault }
+
+func (streamFault) WrapBody(fc *FaultContext, res *http.Response, body io.ReadCloser) io.ReadCloser {
+	if fc.Faults.Stream == nil {
+		return body
+	}
+	ok, sse := isStream(res)
+	if !ok {
+		return body
+	}
+	fc.Logger.Debug("Wrapping streamed response.", "sse", sse)
+	return newStreamBody(body, sse, fc.Faults.Stream, fc.src, fc.Logger, fc.Log)
+}
+
+// postDelayFault sleeps before the response is returned.
+type postDelayFault struct{ NopFault }
+
+func (postDelayFault) AfterResponse(fc *FaultContext, res *http.Response) {
+	d := fc.SampleDelay(fc.Faults.PostDelayRate, fc.Faults.PostDelayMax)
+	fc.Logger.Debug("Sleeping after response returned.", "delay", d)
+	fc.Sleep(FaultPostDelay, PhasePostDelay, d)
+}
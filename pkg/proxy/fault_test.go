@@ -0,0 +1,118 @@
+package proxy_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/a-poor/red-tape/pkg/proxy"
+)
+
+// teapotFault responds to requests to /tea itself, and tags every
+// other response.
+type teapotFault struct{ proxy.NopFault }
+
+func (teapotFault) BeforeRequest(fc *proxy.FaultContext, r *http.Request) (*http.Response, error) {
+	if r.URL.Path != "/tea" {
+		return nil, nil
+	}
+	fc.Decide(proxy.Decision{Fault: "teapot"})
+	return &http.Response{
+		StatusCode: http.StatusTeapot,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    r,
+	}, nil
+}
+
+func (teapotFault) WrapBody(_ *proxy.FaultContext, _ *http.Response, body io.ReadCloser) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(body, strings.NewReader("!")), body}
+}
+
+func (teapotFault) AfterResponse(_ *proxy.FaultContext, res *http.Response) {
+	res.Header.Set("X-Teapot", "yes")
+}
+
+func TestCustomFault(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("coffee"))
+	}))
+	defer up.Close()
+
+	var logs []*proxy.RequestLog
+	rt, err := proxy.NewTransport(nil,
+		proxy.WithFault(teapotFault{}),
+		proxy.WithObserver(observerFunc(func(l *proxy.RequestLog) { logs = append(logs, l) })),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: rt}
+
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/coffee", http.StatusOK, "coffee!"},
+		{"/tea", http.StatusTeapot, "!"},
+	}
+	for _, tt := range tests {
+		res, err := client.Get(up.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != tt.status || string(b) != tt.body || res.Header.Get("X-Teapot") != "yes" {
+			t.Errorf("%s: unexpected response %d %q (%v)", tt.path, res.StatusCode, b, res.Header)
+		}
+	}
+
+	if len(logs) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(logs))
+	}
+	if ds := logs[1].Decisions(); len(ds) != 1 || ds[0].Fault != "teapot" {
+		t.Errorf("expected a teapot decision, got %v", ds)
+	}
+	if logs[1].UpstreamLatency != 0 {
+		t.Error("expected /tea not to be sent upstream")
+	}
+}
+
+func TestPipelineOrder(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+
+	// With the custom fault first, it answers before the drop...
+	cfg := &proxy.ProxyConfig{
+		Faults:   proxy.Faults{ProbDrop: 1},
+		Pipeline: append(proxy.Pipeline{teapotFault{}}, proxy.DefaultPipeline()...),
+	}
+	rt, err := proxy.MakeRoundTripper(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, up.URL+"/tea", nil)
+	req.RequestURI = ""
+	res, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusTeapot {
+		t.Errorf("expected status 418, got %d", res.StatusCode)
+	}
+
+	// ...and the drop still applies to other requests.
+	req = httptest.NewRequest(http.MethodGet, up.URL+"/coffee", nil)
+	req.RequestURI = ""
+	if _, err := rt.RoundTrip(req); err != proxy.ErrDropped {
+		t.Errorf("expected ErrDropped, got %v", err)
+	}
+}
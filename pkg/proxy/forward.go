@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+)
+
+// MakeForwardProxy creates an explicit forward proxy, for clients
+// configured with HTTP_PROXY or HTTPS_PROXY. Absolute-form requests
+// are sent through the fault-injecting round tripper and CONNECT
+// tunnels are dialed with a fault-injecting Dialer. The faults are
+// chosen per destination from cfg's rules. cfg.DestURL is unused.
+func MakeForwardProxy(cfg *ProxyConfig) (http.Handler, error) {
+	logger := cfg.logger()
+
+	// Send requests straight to their destinations, even if HTTP_PROXY
+	// is set in red-tape's own environment (e.g. to red-tape itself)...
+	c := *cfg
+	if c.Transport == nil {
+		t, err := makeTransport(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if ht, ok := t.(*http.Transport); ok {
+			ht = ht.Clone()
+			ht.Proxy = nil
+			c.Transport = ht
+		}
+	}
+
+	// Create the http transport...
+	rt, err := MakeRoundTripper(&c)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the proxy for absolute-form requests...
+	rp := &httputil.ReverseProxy{
+		Transport: rt,
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.Host = r.In.Host
+		},
+		ErrorHandler: makeErrorHandler(logger),
+	}
+	d := MakeDialer(cfg)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodConnect:
+			tunnel(w, r, d)
+		case r.URL.IsAbs():
+			rp.ServeHTTP(w, r)
+		default:
+			http.Error(w, "red-tape: not a proxy request", http.StatusBadRequest)
+		}
+	}), nil
+}
+
+// tunnel handles a CONNECT request, copying data between the client
+// and the destination.
+func tunnel(w http.ResponseWriter, r *http.Request, d *Dialer) {
+	// Connect to the destination...
+	dst, err := d.DialContext(r.Context(), "tcp", r.Host)
+	if errors.Is(err, ErrDropped) {
+		panic(http.ErrAbortHandler)
+	}
+	if err != nil {
+		d.logger.Error("Failed to dial tunnel.", "addr", r.Host, "err", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer dst.Close()
+
+	// Take over the client connection...
+	h, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "red-tape: connection can't be tunneled", http.StatusInternalServerError)
+		return
+	}
+	src, rw, err := h.Hijack()
+	if err != nil {
+		d.logger.Error("Failed to hijack connection.", "err", err)
+		return
+	}
+	defer src.Close()
+	if _, err := io.WriteString(src, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+
+	// Copy in both directions until either side is done...
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(dst, rw.Reader)
+		closeWrite(dst)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(src, dst)
+		closeWrite(src)
+	}()
+	wg.Wait()
+}
+
+// closeWrite half-closes c, if it supports it.
+func closeWrite(c net.Conn) error {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
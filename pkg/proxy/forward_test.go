@@ -0,0 +1,63 @@
+package proxy_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/a-poor/red-tape/pkg/proxy"
+)
+
+func TestForwardProxy(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer up.Close()
+	upTLS := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer upTLS.Close()
+
+	// Drop everything sent to "localhost", but not to 127.0.0.1...
+	h, err := proxy.MakeForwardProxy(&proxy.ProxyConfig{
+		Rules: []proxy.Rule{{Name: "drop", Host: "localhost", Faults: proxy.Faults{ProbDrop: 1}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	pu, _ := url.Parse(srv.URL)
+
+	tr := upTLS.Client().Transport.(*http.Transport).Clone()
+	tr.Proxy = http.ProxyURL(pu)
+	c := &http.Client{Transport: tr}
+
+	// Absolute-form requests...
+	res, err := c.Get(up.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", res.StatusCode)
+	}
+
+	// CONNECT tunnels...
+	res, err = c.Get(upTLS.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d", res.StatusCode)
+	}
+
+	// Dropped destinations...
+	_, port, _ := net.SplitHostPort(up.Listener.Addr().String())
+	if _, err := c.Get("http://localhost:" + port); err == nil {
+		t.Fatal("expected the request to be dropped")
+	}
+}
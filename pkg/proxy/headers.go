@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The header mutations.
+const (
+	// HeaderOpStrip removes the header
+	HeaderOpStrip = "strip"
+
+	// HeaderOpSet sets the header to the value, adding it if it's
+	// missing (e.g. a wrong Content-Length or Content-Encoding)
+	HeaderOpSet = "set"
+
+	// HeaderOpReplace sets the header to the value, only if it's
+	// present (e.g. the Location of redirects)
+	HeaderOpReplace = "replace"
+
+	// HeaderOpDuplicate repeats each of the header's values (e.g.
+	// duplicate Set-Cookie headers)
+	HeaderOpDuplicate = "duplicate"
+
+	// HeaderOpOversize adds a header with a value of Size bytes
+	HeaderOpOversize = "oversize"
+)
+
+// Where header mutations are applied.
+const (
+	HeaderOnResponse = "response"
+	HeaderOnRequest  = "request"
+)
+
+// DefaultOversizeHeader and DefaultOversizeBytes are the name and size
+// of the header added by HeaderOpOversize, if they aren't set.
+const (
+	DefaultOversizeHeader = "X-Red-Tape-Oversized"
+	DefaultOversizeBytes  = 16 * 1024
+)
+
+// HeaderMutation changes a header of requests or responses in flight,
+// like the malformed responses real servers and proxies send.
+type HeaderMutation struct {
+	// The mutation (e.g. HeaderOpStrip)
+	Op string `mapstructure:"op"`
+
+	// Whether to change the request sent upstream or the response
+	// returned to the client (HeaderOnRequest or HeaderOnResponse,
+	// the default)
+	On string `mapstructure:"on"`
+
+	// The header to change
+	Header string `mapstructure:"header"`
+
+	// The value, for HeaderOpSet and HeaderOpReplace
+	Value string `mapstructure:"value"`
+
+	// The size of the value, for HeaderOpOversize (defaults to
+	// DefaultOversizeBytes)
+	Size int `mapstructure:"size"`
+
+	// The probability of applying the mutation
+	Prob float64 `mapstructure:"prob"`
+}
+
+// Validate checks the mutation's settings.
+func (m *HeaderMutation) Validate() error {
+	switch m.Op {
+	case HeaderOpStrip, HeaderOpSet, HeaderOpReplace, HeaderOpDuplicate:
+		if m.Header == "" {
+			return fmt.Errorf("the %s header mutation needs a header", m.Op)
+		}
+	case HeaderOpOversize:
+	default:
+		return fmt.Errorf("unknown header mutation %q", m.Op)
+	}
+	switch m.On {
+	case "", HeaderOnResponse, HeaderOnRequest:
+	default:
+		return fmt.Errorf("unknown header mutation target %q", m.On)
+	}
+	return nil
+}
+
+// apply changes the header in h, returning false if there was nothing
+// to change.
+func (m *HeaderMutation) apply(h http.Header) bool {
+	k := http.CanonicalHeaderKey(m.Header)
+	switch m.Op {
+	case HeaderOpStrip:
+		if _, ok := h[k]; !ok {
+			return false
+		}
+		delete(h, k)
+	case HeaderOpSet:
+		h[k] = []string{m.Value}
+	case HeaderOpReplace:
+		if _, ok := h[k]; !ok {
+			return false
+		}
+		h[k] = []string{m.Value}
+	case HeaderOpDuplicate:
+		vs := h[k]
+		if len(vs) == 0 {
+			return false
+		}
+		h[k] = append(vs[:len(vs):len(vs)], vs...)
+	case HeaderOpOversize:
+		if k == "" {
+			k = DefaultOversizeHeader
+		}
+		n := m.Size
+		if n <= 0 {
+			n = DefaultOversizeBytes
+		}
+		h[k] = []string{strings.Repeat("x", n)}
+	}
+	return true
+}
+
+// name describes the mutation, for the request log.
+func (m *HeaderMutation) name() string {
+	if m.Header == "" {
+		return m.Op
+	}
+	return m.Op + ":" + http.CanonicalHeaderKey(m.Header)
+}
+
+// headerFault applies the header mutations.
+type headerFault struct{ NopFault }
+
+func (headerFault) BeforeRequest(fc *FaultContext, r *http.Request) (*http.Response, error) {
+	cloned := false
+	for i := range fc.Faults.Headers {
+		m := &fc.Faults.Headers[i]
+		if m.On != HeaderOnRequest || !fc.SampleProb(m.Prob) {
+			continue
+		}
+
+		// The request's headers may be shared with the caller's
+		// request, so change a copy...
+		if !cloned {
+			r.Header = r.Header.Clone()
+			if r.Header == nil {
+				r.Header = http.Header{}
+			}
+			cloned = true
+		}
+		if m.apply(r.Header) {
+			fc.Logger.Debug("Changing request header.", "op", m.Op, "header", m.Header)
+			fc.Decide(Decision{Fault: FaultHeader, Value: HeaderOnRequest + ":" + m.name()})
+		}
+	}
+	return nil, nil
+}
+
+func (headerFault) AfterResponse(fc *FaultContext, res *http.Response) {
+	for i := range fc.Faults.Headers {
+		m := &fc.Faults.Headers[i]
+		if m.On == HeaderOnRequest || !fc.SampleProb(m.Prob) {
+			continue
+		}
+		if res.Header == nil {
+			res.Header = http.Header{}
+		}
+		if m.apply(res.Header) {
+			fc.Logger.Debug("Changing response header.", "op", m.Op, "header", m.Header)
+			fc.Decide(Decision{Fault: FaultHeader, Value: HeaderOnResponse + ":" + m.name()})
+		}
+	}
+}
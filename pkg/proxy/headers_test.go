@@ -0,0 +1,120 @@
+package proxy_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/a-poor/red-tape/pkg/proxy"
+)
+
+func TestHeaderMutations(t *testing.T) {
+	var gotAuth []string
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Values("Authorization")
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Write([]byte("{}"))
+	}))
+	defer up.Close()
+
+	p, err := proxy.MakeProxy(&proxy.ProxyConfig{
+		DestURL: up.URL,
+		Faults: proxy.Faults{
+			Headers: []proxy.HeaderMutation{
+				{Op: proxy.HeaderOpStrip, Header: "authorization", On: proxy.HeaderOnRequest, Prob: 1},
+				{Op: proxy.HeaderOpStrip, Header: "Content-Type", Prob: 1},
+				{Op: proxy.HeaderOpReplace, Header: "Cache-Control", Value: "max-age=31536000", Prob: 1},
+				{Op: proxy.HeaderOpReplace, Header: "Location", Value: "http://example.com", Prob: 1},
+				{Op: proxy.HeaderOpDuplicate, Header: "Set-Cookie", Prob: 1},
+				{Op: proxy.HeaderOpOversize, Size: 100, Prob: 1},
+				{Op: proxy.HeaderOpSet, Header: "X-Never", Value: "x", Prob: 0},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("Authorization", "Bearer x")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+
+	if len(gotAuth) != 0 {
+		t.Errorf("expected the Authorization header to be stripped, got %q", gotAuth)
+	}
+	// (The server sniffs a Content-Type if there isn't one.)
+	if ct := res.Header.Get("Content-Type"); ct == "application/json" {
+		t.Error("expected the Content-Type header to be stripped")
+	}
+	if cc := res.Header.Get("Cache-Control"); cc != "max-age=31536000" {
+		t.Errorf("unexpected Cache-Control %q", cc)
+	}
+	if _, ok := res.Header["Location"]; ok {
+		t.Error("expected no Location header to be added")
+	}
+	if cs := res.Header.Values("Set-Cookie"); len(cs) != 2 {
+		t.Errorf("expected a duplicate Set-Cookie header, got %q", cs)
+	}
+	if v := res.Header.Get(proxy.DefaultOversizeHeader); len(v) != 100 {
+		t.Errorf("expected a 100 byte header, got %d bytes", len(v))
+	}
+	if _, ok := res.Header["X-Never"]; ok {
+		t.Error("expected the X-Never header not to be set")
+	}
+}
+
+func TestHeaderMutationContentLength(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	defer up.Close()
+
+	p, err := proxy.MakeProxy(&proxy.ProxyConfig{
+		DestURL: up.URL,
+		Faults: proxy.Faults{
+			Headers: []proxy.HeaderMutation{{Op: proxy.HeaderOpSet, Header: "Content-Length", Value: "100", Prob: 1}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.ContentLength != 100 {
+		t.Errorf("expected a Content-Length of 100, got %d", res.ContentLength)
+	}
+	if _, err := io.ReadAll(res.Body); err == nil {
+		t.Error("expected the body to be cut short")
+	}
+}
+
+func TestHeaderMutationValidate(t *testing.T) {
+	for _, m := range []proxy.HeaderMutation{
+		{Op: "nope", Header: "X"},
+		{Op: proxy.HeaderOpStrip},
+		{Op: proxy.HeaderOpSet, Header: "X", On: "nope"},
+	} {
+		_, err := proxy.MakeRoundTripper(&proxy.ProxyConfig{
+			Faults: proxy.Faults{Headers: []proxy.HeaderMutation{m}},
+		})
+		if err == nil {
+			t.Errorf("%+v: expected an error", m)
+		}
+	}
+}
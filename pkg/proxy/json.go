@@ -0,0 +1,632 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The JSON mutations.
+const (
+	// JSONOpDelete deletes the selected fields or array items
+	JSONOpDelete = "delete"
+
+	// JSONOpNull sets the selected values to null
+	JSONOpNull = "null"
+
+	// JSONOpRetype changes the type of the selected values: numbers
+	// and bools become strings, strings become numbers, and objects
+	// and arrays become strings of their JSON
+	JSONOpRetype = "retype"
+
+	// JSONOpSet sets the selected values to Value
+	JSONOpSet = "set"
+
+	// JSONOpAddField adds the field Field, set to Value, to the
+	// selected objects
+	JSONOpAddField = "add-field"
+
+	// JSONOpShuffle reorders the items of the selected arrays
+	JSONOpShuffle = "shuffle"
+
+	// JSONOpTruncate truncates the selected arrays to Length items
+	JSONOpTruncate = "truncate"
+
+	// JSONOpPatch applies a JSON Patch (RFC 6902) to the response
+	JSONOpPatch = "patch"
+)
+
+// DefaultJSONField and DefaultJSONMaxBody are the field added by
+// JSONOpAddField and the largest response body mutated, if they
+// aren't set.
+const (
+	DefaultJSONField   = "x-red-tape-unknown"
+	DefaultJSONMaxBody = 10 << 20
+)
+
+// JSONMutation changes the JSON of application/json responses, like
+// an upstream making (not quite) backward-compatible API changes.
+type JSONMutation struct {
+	// The mutation (e.g. JSONOpDelete)
+	Op string `mapstructure:"op"`
+
+	// The values to change, as a JSONPath: "$" is the whole
+	// response, ".name" or "['name']" selects a field, "[n]" an
+	// array item (counting back from the end if n is negative) and
+	// ".*" or "[*]" every field or item. Not used for JSONOpPatch.
+	Path string `mapstructure:"path"`
+
+	// The value, for JSONOpSet and JSONOpAddField
+	Value any `mapstructure:"value"`
+
+	// The field to add, for JSONOpAddField (defaults to
+	// DefaultJSONField)
+	Field string `mapstructure:"field"`
+
+	// The number of items to keep, for JSONOpTruncate
+	Length int `mapstructure:"length"`
+
+	// The operations, for JSONOpPatch
+	Patch []JSONPatchOp `mapstructure:"patch"`
+
+	// The probability of applying the mutation
+	Prob float64 `mapstructure:"prob"`
+}
+
+// JSONPatchOp is an operation of a JSON Patch (RFC 6902).
+type JSONPatchOp struct {
+	// The operation: "add", "remove", "replace", "move", "copy" or
+	// "test"
+	Op string `mapstructure:"op"`
+
+	// The JSON Pointer to the value to change
+	Path string `mapstructure:"path"`
+
+	// The JSON Pointer to the value to move or copy
+	From string `mapstructure:"from"`
+
+	// The value to add, replace or test
+	Value any `mapstructure:"value"`
+}
+
+// Validate checks the mutation's settings.
+func (m *JSONMutation) Validate() error {
+	switch m.Op {
+	case JSONOpDelete, JSONOpNull, JSONOpRetype, JSONOpSet, JSONOpAddField, JSONOpShuffle, JSONOpTruncate:
+		if _, err := parseJSONPath(m.Path); err != nil {
+			return err
+		}
+	case JSONOpPatch:
+		for _, p := range m.Patch {
+			if err := p.validate(); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown JSON mutation %q", m.Op)
+	}
+	return nil
+}
+
+func (p *JSONPatchOp) validate() error {
+	switch p.Op {
+	case "add", "remove", "replace", "test":
+	case "move", "copy":
+		if _, err := parsePointer(p.From); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown JSON Patch operation %q", p.Op)
+	}
+	_, err := parsePointer(p.Path)
+	return err
+}
+
+// name describes the mutation, for the request log.
+func (m *JSONMutation) name() string {
+	if m.Op == JSONOpPatch {
+		return m.Op
+	}
+	return m.Op + ":" + m.Path
+}
+
+// jsonFault applies the JSON mutations.
+type jsonFault struct{ NopFault }
+
+func (jsonFault) WrapBody(fc *FaultContext, res *http.Response, body io.ReadCloser) io.ReadCloser {
+	if len(fc.Faults.JSON) == 0 || !isJSON(res) {
+		return body
+	}
+
+	// Pick the mutations to apply...
+	var ms []*JSONMutation
+	for i := range fc.Faults.JSON {
+		if fc.SampleProb(fc.Faults.JSON[i].Prob) {
+			ms = append(ms, &fc.Faults.JSON[i])
+		}
+	}
+	if len(ms) == 0 {
+		return body
+	}
+
+	// ...read the body, passing it on unchanged if it's too big or
+	// isn't valid JSON...
+	b, err := io.ReadAll(io.LimitReader(body, DefaultJSONMaxBody+1))
+	if err != nil || len(b) > DefaultJSONMaxBody {
+		fc.Logger.Debug("Not mutating JSON response.", "err", err, "size", len(b))
+		return readCloser{io.MultiReader(bytes.NewReader(b), &errReader{err}, body), body}
+	}
+	v, err := decodeJSON(b)
+	if err != nil {
+		fc.Logger.Debug("Not mutating invalid JSON response.", "err", err)
+		return readCloser{bytes.NewReader(b), body}
+	}
+
+	// ...and mutate it.
+	changed := false
+	for _, m := range ms {
+		var ok bool
+		if v, ok = m.apply(fc, v); ok {
+			fc.Logger.Debug("Mutating JSON response.", "op", m.Op, "path", m.Path)
+			fc.Decide(Decision{Fault: FaultJSON, Value: m.name()})
+			changed = true
+		}
+	}
+	if changed {
+		if nb, err := json.Marshal(v); err == nil {
+			b = nb
+		}
+	}
+	res.ContentLength = int64(len(b))
+	res.Header.Set("Content-Length", strconv.Itoa(len(b)))
+	res.Header.Del("Transfer-Encoding")
+	return readCloser{bytes.NewReader(b), body}
+}
+
+// errReader returns its error (if it's set) instead of EOF.
+type errReader struct{ err error }
+
+func (r *errReader) Read([]byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	return 0, io.EOF
+}
+
+// isJSON returns true if res has an uncompressed JSON body.
+func isJSON(res *http.Response) bool {
+	if ce := res.Header.Get("Content-Encoding"); ce != "" && ce != "identity" {
+		return false
+	}
+	mt, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	return mt == "application/json" || strings.HasPrefix(mt, "application/") && strings.HasSuffix(mt, "+json")
+}
+
+// decodeJSON decodes a JSON document, keeping numbers as they were
+// written.
+func decodeJSON(b []byte) (any, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after JSON value")
+	}
+	return v, nil
+}
+
+// cloneJSON copies a configured value, so mutations can't change it.
+func cloneJSON(v any) any {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	c, _ := decodeJSON(b)
+	return c
+}
+
+// apply mutates the document v, returning the new document and
+// whether anything was changed.
+func (m *JSONMutation) apply(fc *FaultContext, v any) (any, bool) {
+	if m.Op == JSONOpPatch {
+		nv, err := applyPatch(v, m.Patch)
+		if err != nil {
+			fc.Logger.Debug("Not applying JSON Patch.", "err", err)
+			return v, false
+		}
+		return nv, true
+	}
+	path, err := parseJSONPath(m.Path)
+	if err != nil {
+		return v, false
+	}
+	changed := false
+	v = mutatePath(v, path, func(old any) (any, bool) {
+		nv, keep, ok := m.mutate(fc, old)
+		changed = changed || ok
+		return nv, keep
+	})
+	return v, changed
+}
+
+// mutate returns the new value for a selected value, whether to keep
+// it and whether it was changed.
+func (m *JSONMutation) mutate(fc *FaultContext, v any) (any, bool, bool) {
+	switch m.Op {
+	case JSONOpDelete:
+		return nil, false, true
+	case JSONOpNull:
+		return nil, true, v != nil
+	case JSONOpSet:
+		return cloneJSON(m.Value), true, true
+	case JSONOpRetype:
+		return retype(v), true, true
+	case JSONOpAddField:
+		o, ok := v.(map[string]any)
+		if !ok {
+			return v, true, false
+		}
+		k := m.Field
+		if k == "" {
+			k = DefaultJSONField
+		}
+		o[k] = cloneJSON(m.Value)
+		return o, true, true
+	case JSONOpShuffle:
+		a, ok := v.([]any)
+		if !ok || len(a) < 2 {
+			return v, true, false
+		}
+		fc.Rand.Shuffle(len(a), func(i, j int) { a[i], a[j] = a[j], a[i] })
+		return a, true, true
+	case JSONOpTruncate:
+		a, ok := v.([]any)
+		if !ok || len(a) <= m.Length {
+			return v, true, false
+		}
+		n := m.Length
+		if n < 0 {
+			n = 0
+		}
+		return a[:n], true, true
+	}
+	return v, true, false
+}
+
+// retype converts a value to a different JSON type.
+func retype(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case string:
+		if _, err := strconv.ParseFloat(v, 64); err == nil {
+			return json.Number(v)
+		}
+		return json.Number("0")
+	case nil:
+		return ""
+	default:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+}
+
+// jsonPathSeg is a segment of a JSONPath: a field, an array index or
+// a wildcard.
+type jsonPathSeg struct {
+	key   string
+	index int
+	isIdx bool
+	all   bool
+}
+
+// parseJSONPath parses the subset of JSONPath described for
+// JSONMutation.Path.
+func parseJSONPath(p string) ([]jsonPathSeg, error) {
+	if !strings.HasPrefix(p, "$") {
+		return nil, fmt.Errorf("JSONPath %q must start with \"$\"", p)
+	}
+	var segs []jsonPathSeg
+	s := p[1:]
+	for s != "" {
+		switch {
+		case strings.HasPrefix(s, ".*"):
+			segs = append(segs, jsonPathSeg{all: true})
+			s = s[2:]
+		case s[0] == '.':
+			n := strings.IndexAny(s[1:], ".[")
+			if n < 0 {
+				n = len(s) - 1
+			}
+			if n == 0 {
+				return nil, fmt.Errorf("JSONPath %q has an empty field name", p)
+			}
+			segs = append(segs, jsonPathSeg{key: s[1 : n+1]})
+			s = s[n+1:]
+		case s[0] == '[':
+			end := strings.IndexByte(s, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("JSONPath %q has an unclosed \"[\"", p)
+			}
+			in := s[1:end]
+			switch {
+			case in == "*":
+				segs = append(segs, jsonPathSeg{all: true})
+			case len(in) >= 2 && (in[0] == '\'' || in[0] == '"') && in[len(in)-1] == in[0]:
+				segs = append(segs, jsonPathSeg{key: in[1 : len(in)-1]})
+			default:
+				i, err := strconv.Atoi(in)
+				if err != nil {
+					return nil, fmt.Errorf("JSONPath %q has an invalid index %q", p, in)
+				}
+				segs = append(segs, jsonPathSeg{index: i, isIdx: true})
+			}
+			s = s[end+1:]
+		default:
+			return nil, fmt.Errorf("JSONPath %q is invalid at %q", p, s)
+		}
+	}
+	return segs, nil
+}
+
+// mutatePath calls fn for each value of v selected by path, replacing
+// it with the value fn returns or removing it if fn returns false. It
+// returns the new v.
+func mutatePath(v any, path []jsonPathSeg, fn func(v any) (any, bool)) any {
+	if len(path) == 0 {
+		nv, keep := fn(v)
+		if !keep {
+			return nil
+		}
+		return nv
+	}
+	seg, rest := path[0], path[1:]
+
+	// Fields of objects...
+	if o, ok := v.(map[string]any); ok {
+		if seg.isIdx {
+			return o
+		}
+		for k, c := range o {
+			if !seg.all && k != seg.key {
+				continue
+			}
+			if len(rest) > 0 {
+				o[k] = mutatePath(c, rest, fn)
+			} else if nc, keep := fn(c); keep {
+				o[k] = nc
+			} else {
+				delete(o, k)
+			}
+		}
+		return o
+	}
+
+	// ...and items of arrays.
+	a, ok := v.([]any)
+	if !ok || !seg.all && !seg.isIdx {
+		return v
+	}
+	idx := seg.index
+	if idx < 0 {
+		idx += len(a)
+	}
+	out := a[:0:0]
+	for i, c := range a {
+		if !seg.all && i != idx {
+			out = append(out, c)
+			continue
+		}
+		if len(rest) > 0 {
+			out = append(out, mutatePath(c, rest, fn))
+		} else if nc, keep := fn(c); keep {
+			out = append(out, nc)
+		}
+	}
+	return out
+}
+
+// parsePointer parses a JSON Pointer (RFC 6901) into its tokens.
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if p[0] != '/' {
+		return nil, fmt.Errorf("JSON Pointer %q must start with \"/\"", p)
+	}
+	toks := strings.Split(p[1:], "/")
+	for i, t := range toks {
+		toks[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return toks, nil
+}
+
+// applyPatch applies a JSON Patch to a copy of v, so v is unchanged
+// if it fails.
+func applyPatch(v any, ops []JSONPatchOp) (any, error) {
+	doc := cloneJSON(v)
+	for _, op := range ops {
+		path, err := parsePointer(op.Path)
+		if err != nil {
+			return nil, err
+		}
+		switch op.Op {
+		case "add":
+			doc, err = pointerSet(doc, path, cloneJSON(op.Value), true)
+		case "replace":
+			doc, err = pointerSet(doc, path, cloneJSON(op.Value), false)
+		case "remove":
+			doc, _, err = pointerRemove(doc, path)
+		case "move", "copy":
+			var from []string
+			var val any
+			if from, err = parsePointer(op.From); err != nil {
+				return nil, err
+			}
+			if op.Op == "move" {
+				doc, val, err = pointerRemove(doc, from)
+			} else if val, err = pointerGet(doc, from); err == nil {
+				val = cloneJSON(val)
+			}
+			if err == nil {
+				doc, err = pointerSet(doc, path, val, true)
+			}
+		case "test":
+			var val any
+			if val, err = pointerGet(doc, path); err == nil && !jsonEqual(val, op.Value) {
+				err = fmt.Errorf("test of %q failed", op.Path)
+			}
+		default:
+			err = fmt.Errorf("unknown JSON Patch operation %q", op.Op)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// jsonEqual compares two values as JSON.
+func jsonEqual(a, b any) bool {
+	ab, err1 := json.Marshal(cloneJSON(a))
+	bb, err2 := json.Marshal(cloneJSON(b))
+	return err1 == nil && err2 == nil && bytes.Equal(ab, bb)
+}
+
+// arrayIndex parses an array index token. "-" (past the end) is only
+// allowed when adding.
+func arrayIndex(t string, a []any, add bool) (int, error) {
+	if t == "-" && add {
+		return len(a), nil
+	}
+	i, err := strconv.Atoi(t)
+	last := len(a) - 1
+	if add {
+		last = len(a)
+	}
+	if err != nil || i < 0 || i > last {
+		return 0, fmt.Errorf("invalid array index %q", t)
+	}
+	return i, nil
+}
+
+func pointerGet(v any, path []string) (any, error) {
+	for _, t := range path {
+		switch c := v.(type) {
+		case map[string]any:
+			var ok bool
+			if v, ok = c[t]; !ok {
+				return nil, fmt.Errorf("no field %q", t)
+			}
+		case []any:
+			i, err := arrayIndex(t, c, false)
+			if err != nil {
+				return nil, err
+			}
+			v = c[i]
+		default:
+			return nil, fmt.Errorf("can't index a scalar with %q", t)
+		}
+	}
+	return v, nil
+}
+
+// pointerSet sets the value at path, inserting it into arrays (and
+// allowing new fields) if add is true, and returns the new document.
+func pointerSet(v any, path []string, val any, add bool) (any, error) {
+	if len(path) == 0 {
+		return val, nil
+	}
+	t, rest := path[0], path[1:]
+	switch c := v.(type) {
+	case map[string]any:
+		old, ok := c[t]
+		if len(rest) == 0 {
+			if !ok && !add {
+				return nil, fmt.Errorf("no field %q", t)
+			}
+			c[t] = val
+			return c, nil
+		}
+		if !ok {
+			return nil, fmt.Errorf("no field %q", t)
+		}
+		nv, err := pointerSet(old, rest, val, add)
+		if err != nil {
+			return nil, err
+		}
+		c[t] = nv
+		return c, nil
+	case []any:
+		i, err := arrayIndex(t, c, add && len(rest) == 0)
+		if err != nil {
+			return nil, err
+		}
+		if len(rest) == 0 {
+			if add {
+				c = append(c[:i:i], append([]any{val}, c[i:]...)...)
+			} else {
+				c[i] = val
+			}
+			return c, nil
+		}
+		nv, err := pointerSet(c[i], rest, val, add)
+		if err != nil {
+			return nil, err
+		}
+		c[i] = nv
+		return c, nil
+	}
+	return nil, fmt.Errorf("can't index a scalar with %q", t)
+}
+
+// pointerRemove removes the value at path, returning the new document
+// and the removed value.
+func pointerRemove(v any, path []string) (any, any, error) {
+	if len(path) == 0 {
+		return nil, v, nil
+	}
+	t, rest := path[0], path[1:]
+	switch c := v.(type) {
+	case map[string]any:
+		old, ok := c[t]
+		if !ok {
+			return nil, nil, fmt.Errorf("no field %q", t)
+		}
+		if len(rest) == 0 {
+			delete(c, t)
+			return c, old, nil
+		}
+		nv, removed, err := pointerRemove(old, rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		c[t] = nv
+		return c, removed, nil
+	case []any:
+		i, err := arrayIndex(t, c, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(rest) == 0 {
+			return append(c[:i:i], c[i+1:]...), c[i], nil
+		}
+		nv, removed, err := pointerRemove(c[i], rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		c[i] = nv
+		return c, removed, nil
+	}
+	return nil, nil, fmt.Errorf("can't index a scalar with %q", t)
+}
@@ -0,0 +1,133 @@
+package proxy_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/a-poor/red-tape/pkg/proxy"
+)
+
+func TestJSONMutations(t *testing.T) {
+	const doc = `{"id":7,"name":"x","ok":true,"items":[{"id":1,"tag":"a"},{"id":2,"tag":"b"},{"id":3,"tag":"c"}]}`
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write([]byte(doc))
+	}))
+	defer up.Close()
+
+	tests := []struct {
+		name string
+		m    proxy.JSONMutation
+		want string
+	}{
+		{"delete", proxy.JSONMutation{Op: proxy.JSONOpDelete, Path: "$.items[*].tag"},
+			`{"id":7,"name":"x","ok":true,"items":[{"id":1},{"id":2},{"id":3}]}`},
+		{"delete-item", proxy.JSONMutation{Op: proxy.JSONOpDelete, Path: "$.items[-1]"},
+			`{"id":7,"name":"x","ok":true,"items":[{"id":1,"tag":"a"},{"id":2,"tag":"b"}]}`},
+		{"null", proxy.JSONMutation{Op: proxy.JSONOpNull, Path: "$['name']"},
+			`{"id":7,"name":null,"ok":true,"items":[{"id":1,"tag":"a"},{"id":2,"tag":"b"},{"id":3,"tag":"c"}]}`},
+		{"retype", proxy.JSONMutation{Op: proxy.JSONOpRetype, Path: "$.id"},
+			`{"id":"7","name":"x","ok":true,"items":[{"id":1,"tag":"a"},{"id":2,"tag":"b"},{"id":3,"tag":"c"}]}`},
+		{"set", proxy.JSONMutation{Op: proxy.JSONOpSet, Path: "$.ok", Value: map[string]any{"v": 1}},
+			`{"id":7,"name":"x","ok":{"v":1},"items":[{"id":1,"tag":"a"},{"id":2,"tag":"b"},{"id":3,"tag":"c"}]}`},
+		{"add-field", proxy.JSONMutation{Op: proxy.JSONOpAddField, Path: "$.items[0]", Field: "new", Value: "y"},
+			`{"id":7,"name":"x","ok":true,"items":[{"id":1,"tag":"a","new":"y"},{"id":2,"tag":"b"},{"id":3,"tag":"c"}]}`},
+		{"truncate", proxy.JSONMutation{Op: proxy.JSONOpTruncate, Path: "$.items", Length: 1},
+			`{"id":7,"name":"x","ok":true,"items":[{"id":1,"tag":"a"}]}`},
+		{"patch", proxy.JSONMutation{Op: proxy.JSONOpPatch, Patch: []proxy.JSONPatchOp{
+			{Op: "test", Path: "/id", Value: 7},
+			{Op: "move", From: "/name", Path: "/title"},
+			{Op: "add", Path: "/items/-", Value: 4},
+			{Op: "remove", Path: "/items/0"},
+			{Op: "replace", Path: "/ok", Value: false},
+		}}, `{"id":7,"title":"x","ok":false,"items":[{"id":2,"tag":"b"},{"id":3,"tag":"c"},4]}`},
+		{"failed-patch", proxy.JSONMutation{Op: proxy.JSONOpPatch, Patch: []proxy.JSONPatchOp{
+			{Op: "remove", Path: "/id"},
+			{Op: "test", Path: "/name", Value: "y"},
+		}}, doc},
+	}
+	for _, tt := range tests {
+		tt.m.Prob = 1
+		rt, err := proxy.MakeRoundTripper(&proxy.ProxyConfig{
+			Faults: proxy.Faults{JSON: []proxy.JSONMutation{tt.m}},
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		req, _ := http.NewRequest(http.MethodGet, up.URL, nil)
+		res, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		b, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if res.ContentLength != int64(len(b)) {
+			t.Errorf("%s: Content-Length %d doesn't match the body's %d bytes", tt.name, res.ContentLength, len(b))
+		}
+
+		var got, want any
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatalf("%s: invalid JSON %q", tt.name, b)
+		}
+		json.Unmarshal([]byte(tt.want), &want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.want, b)
+		}
+	}
+}
+
+func TestJSONMutationShuffle(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.Write([]byte(`[1,2,3,4,5,6,7,8,9,10]`))
+	}))
+	defer up.Close()
+
+	rt, err := proxy.MakeRoundTripper(&proxy.ProxyConfig{
+		Seed:   1,
+		Faults: proxy.Faults{JSON: []proxy.JSONMutation{{Op: proxy.JSONOpShuffle, Path: "$", Prob: 1}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, up.URL, nil)
+	res, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var got []int
+	if err := json.NewDecoder(res.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	sum := 0
+	sorted := true
+	for i, n := range got {
+		sum += n
+		sorted = sorted && n == i+1
+	}
+	if len(got) != 10 || sum != 55 || sorted {
+		t.Errorf("expected the items to be shuffled, got %v", got)
+	}
+}
+
+func TestJSONMutationValidate(t *testing.T) {
+	for _, m := range []proxy.JSONMutation{
+		{Op: "nope", Path: "$"},
+		{Op: proxy.JSONOpDelete, Path: "items"},
+		{Op: proxy.JSONOpDelete, Path: "$.items[x]"},
+		{Op: proxy.JSONOpPatch, Patch: []proxy.JSONPatchOp{{Op: "nope", Path: "/a"}}},
+		{Op: proxy.JSONOpPatch, Patch: []proxy.JSONPatchOp{{Op: "add", Path: "a"}}},
+	} {
+		_, err := proxy.MakeRoundTripper(&proxy.ProxyConfig{
+			Faults: proxy.Faults{JSON: []proxy.JSONMutation{m}},
+		})
+		if err == nil {
+			t.Errorf("%+v: expected an error", m)
+		}
+	}
+}
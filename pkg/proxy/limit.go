@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The orders queued requests can be let through in.
+const (
+	QueueFIFO = "fifo"
+	QueueLIFO = "lifo"
+)
+
+// ConcurrencyConfig limits how many requests are sent upstream at
+// once, to emulate an overloaded upstream. Requests over the limit
+// wait in a queue for a slot.
+type ConcurrencyConfig struct {
+	// The maximum number of requests in flight upstream
+	// (0 means no limit)
+	MaxConcurrent int `mapstructure:"max-concurrent"`
+
+	// The maximum number of requests waiting for a slot. Requests
+	// arriving when the queue is full are rejected with a 503.
+	QueueDepth int `mapstructure:"queue-depth"`
+
+	// The maximum time a request waits in the queue before it's
+	// rejected with a 503, in ms (0 means no limit)
+	MaxWait float64 `mapstructure:"max-wait"`
+
+	// The order queued requests are let through in, either QueueFIFO
+	// or QueueLIFO (defaults to QueueFIFO)
+	Order string `mapstructure:"order"`
+
+	// If set, requests arriving when the queue is full aren't
+	// rejected. Instead they're delayed this long (in ms) for each
+	// queued request and then sent, over the limit.
+	OverflowDelay float64 `mapstructure:"overflow-delay"`
+}
+
+// limiter limits the requests in flight upstream, queueing the rest.
+type limiter struct {
+	cfg ConcurrencyConfig
+
+	mu      sync.Mutex
+	active  int
+	waiters []chan struct{}
+}
+
+func makeLimiter(cfg *ConcurrencyConfig) (*limiter, error) {
+	switch cfg.Order {
+	case "", QueueFIFO, QueueLIFO:
+	default:
+		return nil, fmt.Errorf("unknown queue order %q", cfg.Order)
+	}
+	if cfg.MaxConcurrent <= 0 {
+		return nil, nil
+	}
+	return &limiter{cfg: *cfg}, nil
+}
+
+// acquire waits for a slot, recording the wait in l. It returns a
+// function releasing the slot, or false if the request was rejected.
+// It's safe to call on a nil limiter.
+func (lim *limiter) acquire(ctx context.Context, l *RequestLog) (func(), bool) {
+	if lim == nil {
+		return func() {}, true
+	}
+	lim.mu.Lock()
+
+	// Take a free slot...
+	if lim.active < lim.cfg.MaxConcurrent && len(lim.waiters) == 0 {
+		lim.active++
+		lim.mu.Unlock()
+		return lim.release, true
+	}
+
+	// ...or, if the queue is full, reject the request or delay it...
+	if n := len(lim.waiters); n >= lim.cfg.QueueDepth {
+		lim.mu.Unlock()
+		if lim.cfg.OverflowDelay <= 0 {
+			l.decide(Decision{Fault: FaultQueueFull, Value: strconv.Itoa(n)})
+			return nil, false
+		}
+		d := time.Duration(lim.cfg.OverflowDelay * float64(n) * float64(time.Millisecond))
+		l.delay(FaultQueueFull, d)
+		l.sleep(PhaseQueue, d)
+		return func() {}, true
+	}
+
+	// ...or wait in the queue...
+	ch := make(chan struct{})
+	lim.waiters = append(lim.waiters, ch)
+	lim.mu.Unlock()
+	start := time.Now()
+	var timeout <-chan time.Time
+	if lim.cfg.MaxWait > 0 {
+		t := time.NewTimer(time.Duration(lim.cfg.MaxWait * float64(time.Millisecond)))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-ch:
+	case <-timeout:
+	case <-ctx.Done():
+	}
+	waited := time.Since(start)
+	l.phase(PhaseQueue, start, start.Add(waited))
+
+	// If the request gave up, take it out of the queue. If it was let
+	// through in the meantime, it has the slot anyway...
+	lim.mu.Lock()
+	granted := true
+	for i, w := range lim.waiters {
+		if w == ch {
+			lim.waiters = append(lim.waiters[:i], lim.waiters[i+1:]...)
+			granted = false
+			break
+		}
+	}
+	lim.mu.Unlock()
+	if !granted {
+		l.decide(Decision{Fault: FaultQueueTimeout, Delay: waited})
+		return nil, false
+	}
+	l.delay(FaultQueue, waited)
+	return lim.release, true
+}
+
+// release frees a slot, passing it to the next queued request if
+// there is one.
+func (lim *limiter) release() {
+	lim.mu.Lock()
+	defer lim.mu.Unlock()
+	n := len(lim.waiters)
+	if n == 0 {
+		lim.active--
+		return
+	}
+	var ch chan struct{}
+	if lim.cfg.Order == QueueLIFO {
+		ch = lim.waiters[n-1]
+		lim.waiters = lim.waiters[:n-1]
+	} else {
+		ch = lim.waiters[0]
+		lim.waiters = lim.waiters[1:]
+	}
+	close(ch)
+}
@@ -0,0 +1,101 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/a-poor/red-tape/pkg/proxy"
+)
+
+func TestConcurrencyLimit(t *testing.T) {
+	release := make(chan struct{})
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer up.Close()
+
+	rt, err := proxy.MakeRoundTripper(&proxy.ProxyConfig{
+		DestURL:     up.URL,
+		Concurrency: proxy.ConcurrencyConfig{MaxConcurrent: 1, QueueDepth: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	do := func() int {
+		req, _ := http.NewRequest(http.MethodGet, up.URL, nil)
+		res, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Error(err)
+			return 0
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// Fill the slot and the queue...
+	var wg sync.WaitGroup
+	statuses := make([]int, 2)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses[i] = do()
+		}(i)
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// ...so the next request is rejected...
+	if got := do(); got != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503 with a full queue, got %d", got)
+	}
+
+	// ...and the queued request gets through once the slot is free.
+	close(release)
+	wg.Wait()
+	for i, s := range statuses {
+		if s != http.StatusOK {
+			t.Errorf("request %d: expected status 200, got %d", i, s)
+		}
+	}
+}
+
+func TestConcurrencyMaxWait(t *testing.T) {
+	release := make(chan struct{})
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer up.Close()
+	defer close(release)
+
+	rt, err := proxy.MakeRoundTripper(&proxy.ProxyConfig{
+		DestURL:     up.URL,
+		Concurrency: proxy.ConcurrencyConfig{MaxConcurrent: 1, QueueDepth: 10, MaxWait: 30},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, up.URL, nil)
+		if res, err := rt.RoundTrip(req); err == nil {
+			res.Body.Close()
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	req, _ := http.NewRequest(http.MethodGet, up.URL, nil)
+	start := time.Now()
+	res, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503 after waiting, got %d", res.StatusCode)
+	}
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Errorf("expected to wait at least 30ms, waited %s", d)
+	}
+}
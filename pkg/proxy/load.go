@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// The load-dependent latency models.
+const (
+	// LoadPower adds a delay of Base + K * inflight^Power
+	LoadPower = "power"
+
+	// LoadMMC adds the response time of an M/M/c queue with the
+	// requests in flight in the system
+	LoadMMC = "mmc"
+)
+
+// LoadConfig configures latency that grows with the number of
+// requests in flight through the proxy, like a saturated service.
+type LoadConfig struct {
+	// The model, either LoadPower or LoadMMC (defaults to LoadPower)
+	Model string `mapstructure:"model"`
+
+	// For LoadPower, the delay with nothing else in flight (ms)
+	Base float64 `mapstructure:"base"`
+
+	// For LoadPower, the delay per in-flight request (ms)
+	K float64 `mapstructure:"k"`
+
+	// For LoadPower, the exponent applied to the in-flight count
+	// (defaults to 1, and 0 makes the delay constant)
+	Power *float64 `mapstructure:"power"`
+
+	// For LoadMMC, the number of servers
+	Servers int `mapstructure:"servers"`
+
+	// For LoadMMC, the mean service time of each server (ms)
+	ServiceTime float64 `mapstructure:"service-time"`
+}
+
+// Validate checks the load model's settings.
+func (c *LoadConfig) Validate() error {
+	switch c.Model {
+	case "", LoadPower, LoadMMC:
+	default:
+		return fmt.Errorf("unknown load model %q", c.Model)
+	}
+	if c.Base < 0 || c.K < 0 || c.ServiceTime < 0 {
+		return fmt.Errorf("load delays must not be negative")
+	}
+	if c.Power != nil && *c.Power < 0 {
+		return fmt.Errorf("load power must not be negative, got %v", *c.Power)
+	}
+	if c.Model == LoadMMC && c.ServiceTime > 0 && c.Servers <= 0 {
+		return fmt.Errorf("the %s load model needs at least one server", LoadMMC)
+	}
+	return nil
+}
+
+// delay returns the delay for a request arriving with n other
+// requests in flight.
+func (c *LoadConfig) delay(n int64) time.Duration {
+	var ms float64
+	switch c.Model {
+	case LoadMMC:
+		// With exponential service times, a request arriving to find
+		// n requests in the system waits for n-c+1 of them to finish
+		// (once every S/c, on average) before being served itself...
+		if c.Servers <= 0 {
+			return 0
+		}
+		ms = c.ServiceTime
+		if q := n - int64(c.Servers) + 1; q > 0 {
+			ms += float64(q) * c.ServiceTime / float64(c.Servers)
+		}
+	default:
+		p := 1.0
+		if c.Power != nil {
+			p = *c.Power
+		}
+		ms = c.Base + c.K*math.Pow(float64(n), p)
+	}
+	if ms <= 0 {
+		return 0
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
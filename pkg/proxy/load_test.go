@@ -0,0 +1,122 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/a-poor/red-tape/pkg/proxy"
+)
+
+// loadDelay sends a request through rt while another is held in
+// flight, returning the load delay added to it.
+func loadDelay(t *testing.T, load *proxy.LoadConfig) time.Duration {
+	t.Helper()
+	hold := make(chan struct{})
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hold" {
+			<-hold
+		}
+	}))
+	defer up.Close()
+	defer close(hold)
+
+	var d time.Duration
+	rt, err := proxy.MakeRoundTripper(&proxy.ProxyConfig{
+		DestURL: up.URL,
+		Faults:  proxy.Faults{Load: load},
+		Observers: []proxy.Observer{observerFunc(func(l *proxy.RequestLog) {
+			if l.Status == http.StatusOK && l.URL == up.URL+"/" {
+				d = l.AddedDelay()
+			}
+		})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, up.URL+"/hold", nil)
+		if res, err := rt.RoundTrip(req); err == nil {
+			res.Body.Close()
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	req, _ := http.NewRequest(http.MethodGet, up.URL+"/", nil)
+	res, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return d
+}
+
+type observerFunc func(l *proxy.RequestLog)
+
+func (f observerFunc) Observe(l *proxy.RequestLog) { f(l) }
+
+func TestLoadPower(t *testing.T) {
+	p := 2.0
+	d := loadDelay(t, &proxy.LoadConfig{Base: 5, K: 10, Power: &p})
+	if d != 15*time.Millisecond {
+		t.Errorf("expected a load delay of 15ms, got %s", d)
+	}
+}
+
+func TestLoadPowerConstant(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+
+	// With a power of 0, the delay is the same with nothing else in
+	// flight...
+	var d time.Duration
+	p := 0.0
+	rt, err := proxy.MakeRoundTripper(&proxy.ProxyConfig{
+		DestURL: up.URL,
+		Faults:  proxy.Faults{Load: &proxy.LoadConfig{Base: 5, K: 10, Power: &p}},
+		Observers: []proxy.Observer{observerFunc(func(l *proxy.RequestLog) {
+			d = l.AddedDelay()
+		})},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, up.URL+"/", nil)
+	res, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if d != 15*time.Millisecond {
+		t.Errorf("expected a load delay of 15ms, got %s", d)
+	}
+
+	// ...as with another in flight.
+	if d := loadDelay(t, &proxy.LoadConfig{Base: 5, K: 10, Power: &p}); d != 15*time.Millisecond {
+		t.Errorf("expected a load delay of 15ms, got %s", d)
+	}
+}
+
+func TestLoadMMC(t *testing.T) {
+	d := loadDelay(t, &proxy.LoadConfig{Model: proxy.LoadMMC, Servers: 1, ServiceTime: 10})
+	if d != 20*time.Millisecond {
+		t.Errorf("expected a load delay of 20ms, got %s", d)
+	}
+}
+
+func TestLoadValidate(t *testing.T) {
+	p := -1.0
+	for _, load := range []*proxy.LoadConfig{
+		{Model: "linear"},
+		{Base: -1},
+		{K: -1},
+		{Power: &p},
+		{Model: proxy.LoadMMC, ServiceTime: -1, Servers: 1},
+		{Model: proxy.LoadMMC, ServiceTime: 10},
+	} {
+		if err := load.Validate(); err == nil {
+			t.Errorf("expected an error for %+v", *load)
+		}
+	}
+}
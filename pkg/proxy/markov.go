@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/exp/rand"
+)
+
+// The scopes a StateModel's state can be kept in.
+const (
+	ScopeGlobal   = "global"
+	ScopeClient   = "client"
+	ScopeUpstream = "upstream"
+)
+
+// StateModel is a Markov model of the proxy's health, like the
+// Gilbert-Elliott model's "good" and "bad" states. Each request
+// moves the model between states, and is given the faults of the
+// state it lands in, so failures come in bursts rather than being
+// independent.
+type StateModel struct {
+	// Where the state is kept. ScopeGlobal (the default) shares one
+	// state between all requests, ScopeClient keeps one per client IP
+	// and ScopeUpstream keeps one per upstream host.
+	Scope string `mapstructure:"scope"`
+
+	// The states. The model starts in the first one.
+	States []State `mapstructure:"states"`
+}
+
+// State is a state of a StateModel.
+type State struct {
+	// The state's name
+	Name string `mapstructure:"name"`
+
+	// The probability of moving to each other state (by name) on
+	// each request. The model stays in this state otherwise.
+	Transitions map[string]float64 `mapstructure:"transitions"`
+
+	// The drop, delay and error faults (including network errors)
+	// injected in this state. They replace those of the rule using
+	// the model.
+	Faults `mapstructure:",squash"`
+}
+
+// Validate checks the model's states and transitions.
+func (m *StateModel) Validate() error {
+	switch m.Scope {
+	case "", ScopeGlobal, ScopeClient, ScopeUpstream:
+	default:
+		return fmt.Errorf("unknown state model scope %q", m.Scope)
+	}
+	if len(m.States) == 0 {
+		return fmt.Errorf("state model has no states")
+	}
+	names := map[string]bool{}
+	for _, s := range m.States {
+		if names[s.Name] {
+			return fmt.Errorf("duplicate state %q", s.Name)
+		}
+		names[s.Name] = true
+	}
+	for _, s := range m.States {
+		var sum float64
+		for to, p := range s.Transitions {
+			if !names[to] {
+				return fmt.Errorf("state %q has a transition to unknown state %q", s.Name, to)
+			}
+			if p < 0 {
+				return fmt.Errorf("state %q has a negative transition probability", s.Name)
+			}
+			sum += p
+		}
+		if sum > 1 {
+			return fmt.Errorf("state %q's transition probabilities add up to more than 1", s.Name)
+		}
+	}
+	return nil
+}
+
+// stateKey identifies a state model's state within a scope.
+type stateKey struct {
+	m     *StateModel
+	scope string
+}
+
+// stateChains keeps the current state of each state model, per
+// scope.
+type stateChains struct {
+	mu     sync.Mutex
+	states map[stateKey]int
+}
+
+func newStateChains() *stateChains {
+	return &stateChains{states: map[stateKey]int{}}
+}
+
+// step moves m's state for the scope on by one request and returns
+// the new state.
+func (c *stateChains) step(src rand.Source, m *StateModel, client, upstream string) *State {
+	k := stateKey{m: m}
+	switch m.Scope {
+	case ScopeClient:
+		k.scope = client
+	case ScopeUpstream:
+		k.scope = upstream
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Pick the next state, checking the transitions in the order the
+	// states are listed so seeded runs are repeatable...
+	cur := c.states[k]
+	u := rand.New(src).Float64()
+	for i, s := range m.States {
+		p := m.States[cur].Transitions[s.Name]
+		if i == cur || p <= 0 {
+			continue
+		}
+		if u < p {
+			cur = i
+			break
+		}
+		u -= p
+	}
+	c.states[k] = cur
+	return &m.States[cur]
+}
+
+// withState returns f with its drop, delay and error faults replaced
+// by those of the state s.
+func (f *Faults) withState(s *State) *Faults {
+	f2 := *f
+	f2.ProbDrop = s.ProbDrop
+	f2.PreDelayRate = s.PreDelayRate
+	f2.PreDelayMax = s.PreDelayMax
+	f2.PostDelayRate = s.PostDelayRate
+	f2.PostDelayMax = s.PostDelayMax
+	f2.ProbError = s.ProbError
+	f2.ProbNetError = s.ProbNetError
+	f2.NetErrors = s.NetErrors
+	f2.ErrorStatus = s.ErrorStatus
+	f2.States = nil
+	return &f2
+}
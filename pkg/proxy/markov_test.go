@@ -0,0 +1,53 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/a-poor/red-tape/pkg/proxy"
+)
+
+func TestStateModel(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+
+	rt, err := proxy.MakeRoundTripper(&proxy.ProxyConfig{
+		DestURL: up.URL,
+		Faults: proxy.Faults{States: &proxy.StateModel{
+			States: []proxy.State{
+				{Name: "good", Transitions: map[string]float64{"bad": 1}},
+				{Name: "bad", Transitions: map[string]float64{"good": 1}, Faults: proxy.Faults{ProbError: 1}},
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The model flips between states on every request...
+	for i, want := range []int{503, 200, 503, 200} {
+		req, _ := http.NewRequest(http.MethodGet, up.URL, nil)
+		res, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != want {
+			t.Errorf("request %d: expected status %d, got %d", i, want, res.StatusCode)
+		}
+	}
+}
+
+func TestStateModelValidate(t *testing.T) {
+	_, err := proxy.MakeRoundTripper(&proxy.ProxyConfig{
+		Faults: proxy.Faults{States: &proxy.StateModel{
+			States: []proxy.State{
+				{Name: "good", Transitions: map[string]float64{"ugly": 0.1}},
+			},
+		}},
+	})
+	if err == nil {
+		t.Fatal("expected an error for a transition to an unknown state")
+	}
+}
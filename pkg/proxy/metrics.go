@@ -0,0 +1,301 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// The labels metrics can be broken down by.
+const (
+	LabelRule     = "rule"
+	LabelUpstream = "upstream"
+	LabelStatus   = "status"
+)
+
+// The default histogram buckets, in seconds.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// MetricsConfig configures red-tape's Prometheus metrics.
+type MetricsConfig struct {
+	// The labels to break metrics down by. Any of LabelRule,
+	// LabelUpstream and LabelStatus (defaults to all three). Leave
+	// out labels to keep cardinality down.
+	Labels []string `mapstructure:"labels"`
+
+	// Report status codes by class (e.g. "5xx") rather than by code
+	StatusClass bool `mapstructure:"status-class"`
+
+	// The histogram buckets, in seconds (defaults to DefaultBuckets)
+	Buckets []float64 `mapstructure:"buckets"`
+}
+
+// Metrics collects Prometheus metrics about proxied requests and the
+// faults injected into them. It's an http.Handler serving the
+// metrics in the Prometheus text format. Only HTTP requests are
+// metered: the connections tunnelled with CONNECT or SOCKS5 aren't.
+type Metrics struct {
+	rule, upstream, status bool
+	statusClass            bool
+
+	inFlight        int64
+	requests        *counterVec
+	faults          *counterVec
+	bytesIn         *counterVec
+	bytesOut        *counterVec
+	addedDelay      *histogramVec
+	upstreamLatency *histogramVec
+}
+
+// MakeMetrics creates a Metrics collector.
+func MakeMetrics(cfg *MetricsConfig) (*Metrics, error) {
+	m := &Metrics{statusClass: cfg.StatusClass}
+
+	// Pick the labels...
+	labels := cfg.Labels
+	if labels == nil {
+		labels = []string{LabelRule, LabelUpstream, LabelStatus}
+	}
+	for _, l := range labels {
+		switch l {
+		case LabelRule:
+			m.rule = true
+		case LabelUpstream:
+			m.upstream = true
+		case LabelStatus:
+			m.status = true
+		default:
+			return nil, fmt.Errorf("unknown metric label %q", l)
+		}
+	}
+	buckets := cfg.Buckets
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+
+	// Create the metrics...
+	base := m.labelNames(false)
+	m.requests = newCounterVec("red_tape_requests_total", "Requests proxied.", m.labelNames(true))
+	m.faults = newCounterVec("red_tape_faults_total", "Faults injected, by type.", append(append([]string(nil), base...), "fault"))
+	m.bytesIn = newCounterVec("red_tape_request_bytes_total", "Request body bytes sent upstream.", base)
+	m.bytesOut = newCounterVec("red_tape_response_bytes_total", "Response body bytes returned to clients.", base)
+	m.addedDelay = newHistogramVec("red_tape_added_delay_seconds", "Delay injected per request.", base, buckets)
+	m.upstreamLatency = newHistogramVec("red_tape_upstream_latency_seconds", "Time for the upstream to return response headers.", base, buckets)
+	return m, nil
+}
+
+// Observe records a completed request.
+func (m *Metrics) Observe(l *RequestLog) {
+	base := m.labelValues(l, false)
+	m.requests.add(m.labelValues(l, true), 1)
+	for _, d := range l.Decisions() {
+		m.faults.add(append(base[:len(base):len(base)], d.Fault), 1)
+	}
+	m.bytesIn.add(base, float64(l.BytesIn))
+	m.bytesOut.add(base, float64(l.BytesOut))
+	m.addedDelay.observe(base, l.AddedDelay().Seconds())
+	if l.Status != 0 {
+		m.upstreamLatency.observe(base, l.UpstreamLatency.Seconds())
+	}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	fmt.Fprintln(w, "# HELP red_tape_in_flight_requests Requests currently being proxied.")
+	fmt.Fprintln(w, "# TYPE red_tape_in_flight_requests gauge")
+	fmt.Fprintf(w, "red_tape_in_flight_requests %d\n", atomic.LoadInt64(&m.inFlight))
+	m.requests.write(w)
+	m.faults.write(w)
+	m.bytesIn.write(w)
+	m.bytesOut.write(w)
+	m.addedDelay.write(w)
+	m.upstreamLatency.write(w)
+}
+
+// track counts a request as in flight, until the returned function
+// is called. It's safe to call on nil Metrics.
+func (m *Metrics) track() func() {
+	if m == nil {
+		return func() {}
+	}
+	atomic.AddInt64(&m.inFlight, 1)
+	return func() { atomic.AddInt64(&m.inFlight, -1) }
+}
+
+func (m *Metrics) labelNames(withStatus bool) []string {
+	var names []string
+	if m.rule {
+		names = append(names, LabelRule)
+	}
+	if m.upstream {
+		names = append(names, LabelUpstream)
+	}
+	if withStatus && m.status {
+		names = append(names, LabelStatus)
+	}
+	return names
+}
+
+func (m *Metrics) labelValues(l *RequestLog, withStatus bool) []string {
+	var vals []string
+	if m.rule {
+		rule := l.Rule
+		if rule == "" {
+			rule = "default"
+		}
+		vals = append(vals, rule)
+	}
+	if m.upstream {
+		vals = append(vals, l.Upstream)
+	}
+	if withStatus && m.status {
+		vals = append(vals, m.statusValue(l))
+	}
+	return vals
+}
+
+func (m *Metrics) statusValue(l *RequestLog) string {
+	switch {
+	case l.Status == 0 && errors.Is(l.Err, ErrDropped):
+		return "dropped"
+	case l.Status == 0:
+		return "error"
+	case m.statusClass:
+		return strconv.Itoa(l.Status/100) + "xx"
+	default:
+		return strconv.Itoa(l.Status)
+	}
+}
+
+// counterVec is a counter broken down by labels.
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels []string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (c *counterVec) add(vals []string, v float64) {
+	k := formatLabels(c.labels, vals)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[k] += v
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, k := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, k, formatFloat(c.values[k]))
+	}
+}
+
+// histogramVec is a histogram broken down by labels.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+type histogram struct {
+	vals   []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, labels []string, buckets []float64) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histogram{}}
+}
+
+func (h *histogramVec) observe(vals []string, v float64) {
+	k := formatLabels(h.labels, vals)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.values[k]
+	if !ok {
+		hist = &histogram{vals: vals, counts: make([]uint64, len(h.buckets))}
+		h.values[k] = hist
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += v
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	names := append(h.labels[:len(h.labels):len(h.labels)], "le")
+	for _, k := range sortedKeys(h.values) {
+		hist := h.values[k]
+		vals := hist.vals[:len(hist.vals):len(hist.vals)]
+		for i, b := range h.buckets {
+			bk := formatLabels(names, append(vals, formatFloat(b)))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, bk, hist.counts[i])
+		}
+		inf := formatLabels(names, append(vals, "+Inf"))
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, inf, hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, k, formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, k, hist.count)
+	}
+}
+
+// formatLabels formats a set of labels, like `{a="1",b="2"}`.
+func formatLabels(names, vals []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(n)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(vals[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,68 @@
+package proxy_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/a-poor/red-tape/pkg/proxy"
+)
+
+func TestMetrics(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer up.Close()
+
+	m, err := proxy.MakeMetrics(&proxy.MetricsConfig{Labels: []string{proxy.LabelRule, proxy.LabelStatus}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := proxy.MakeProxy(&proxy.ProxyConfig{
+		DestURL: up.URL,
+		Faults:  proxy.Faults{PreDelayRate: 1, PreDelayMax: 1},
+		Metrics: m,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	for i := 0; i < 2; i++ {
+		res, err := http.Post(srv.URL, "text/plain", strings.NewReader("hi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(res.Body)
+		res.Body.Close()
+	}
+
+	// Requests are observed once the proxy closes the response body,
+	// which can be just after the client has read it...
+	var out string
+	for i := 0; i < 100; i++ {
+		rec := httptest.NewRecorder()
+		m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if out = rec.Body.String(); strings.Contains(out, "red_tape_in_flight_requests 0") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, want := range []string{
+		`red_tape_in_flight_requests 0`,
+		`red_tape_requests_total{rule="default",status="200"} 2`,
+		`red_tape_faults_total{rule="default",fault="pre-delay"} 2`,
+		`red_tape_request_bytes_total{rule="default"} 4`,
+		`red_tape_response_bytes_total{rule="default"} 10`,
+		`red_tape_added_delay_seconds_bucket{rule="default",le="+Inf"} 2`,
+		`red_tape_upstream_latency_seconds_count{rule="default"} 2`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected metrics to contain %q, got:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// handlerKey is the context key for the handler a Middleware request
+// is served by.
+type handlerKey struct{}
+
+// served is the handler a Middleware request is served by, and the
+// request as the server received it.
+type served struct {
+	h  http.Handler
+	in *http.Request
+}
+
+// handlerPanic is the error returned when a Middleware's handler
+// panics, so the panic can be passed on to the server.
+type handlerPanic struct{ v any }
+
+func (p handlerPanic) Error() string {
+	return fmt.Sprintf("red-tape: handler panicked: %v", p.v)
+}
+
+// Middleware returns middleware that injects the configured faults
+// into the requests served by a handler, as MakeRoundTripper does for
+// proxied requests. For example, to turn on chaos behind a flag:
+//
+//	mw, err := proxy.Middleware(&proxy.ProxyConfig{
+//		Faults: proxy.Faults{ProbError: 0.05},
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	if chaos {
+//		h = mw(h)
+//	}
+//
+// The DestURL, Transport, UpstreamTLS and Replay settings are ignored,
+// and rules are matched against the request's Host.
+func Middleware(cfg *ProxyConfig) (func(http.Handler) http.Handler, error) {
+	// Send requests to the wrapped handler instead of upstream...
+	c := *cfg
+	c.DestURL = ""
+	c.UpstreamTLS = nil
+	c.Replay = ReplayConfig{}
+	c.Transport = roundTripperFunc(serveHandler)
+
+	// Create the round tripper...
+	rt, err := MakeRoundTripper(&c)
+	if err != nil {
+		return nil, err
+	}
+	onError := makeErrorHandler(c.logger())
+
+	// Return the middleware...
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Send the request through the faults...
+			out := r.Clone(context.WithValue(r.Context(), handlerKey{}, served{next, r}))
+			out.RequestURI = ""
+			out.URL.Host = r.Host
+			out.URL.Scheme = "http"
+			if r.TLS != nil {
+				out.URL.Scheme = "https"
+			}
+			res, err := rt.RoundTrip(out)
+			var hp handlerPanic
+			if errors.As(err, &hp) {
+				panic(hp.v)
+			}
+			if err != nil {
+				onError(w, r, err)
+				return
+			}
+			defer res.Body.Close()
+
+			// ...and write the response...
+			h := w.Header()
+			for k, vs := range res.Header {
+				h[k] = vs
+			}
+			if res.ContentLength >= 0 && h.Get("Content-Length") == "" {
+				h.Set("Content-Length", strconv.FormatInt(res.ContentLength, 10))
+			}
+			for k := range res.Trailer {
+				h.Add("Trailer", k)
+			}
+			w.WriteHeader(res.StatusCode)
+			if err := copyBody(w, res.Body, res.ContentLength < 0); err != nil {
+				if errors.As(err, &hp) {
+					panic(hp.v)
+				}
+				return
+			}
+
+			// ...then the trailers.
+			res.Body.Close()
+			for k, vs := range res.Trailer {
+				h[http.TrailerPrefix+k] = vs
+			}
+		})
+	}, nil
+}
+
+// copyBody copies a response body to w, flushing after each write if
+// it's streamed.
+func copyBody(w http.ResponseWriter, body io.Reader, stream bool) error {
+	f, _ := w.(http.Flusher)
+	if !stream || f == nil {
+		_, err := io.Copy(w, body)
+		return err
+	}
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			f.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// serveHandler serves a request with the handler in its context,
+// returning the response as soon as the handler writes its headers.
+// The body is streamed from the handler as it's written.
+func serveHandler(r *http.Request) (*http.Response, error) {
+	s, ok := r.Context().Value(handlerKey{}).(served)
+	if !ok {
+		return nil, errors.New("red-tape: no handler for request")
+	}
+
+	// Pass the handler the request as the server received it, with
+	// the faults' changes to the context, headers and body...
+	in := s.in.WithContext(r.Context())
+	in.Header = r.Header
+	in.Body = r.Body
+	pr, pw := io.Pipe()
+	w := &pipeWriter{
+		r:      r,
+		header: http.Header{},
+		pr:     pr,
+		pw:     pw,
+		res:    make(chan *http.Response, 1),
+		errc:   make(chan error, 1),
+	}
+
+	// Run the handler...
+	go func() {
+		defer func() {
+			if v := recover(); v != nil {
+				w.fail(handlerPanic{v})
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			w.finish()
+			pw.Close()
+		}()
+		s.h.ServeHTTP(w, in)
+	}()
+
+	// ...and wait for the headers.
+	select {
+	case res := <-w.res:
+		return res, nil
+	case err := <-w.errc:
+		return nil, err
+	}
+}
+
+// pipeWriter is the http.ResponseWriter passed to a Middleware's
+// handler. The body is written to a pipe, read by the round tripper.
+type pipeWriter struct {
+	r      *http.Request
+	header http.Header
+	pr     *io.PipeReader
+	pw     *io.PipeWriter
+
+	once    sync.Once
+	trailer http.Header // The trailers, set once the handler returns
+	res     chan *http.Response
+	errc    chan error
+}
+
+func (w *pipeWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *pipeWriter) WriteHeader(status int) {
+	w.once.Do(func() {
+		res := &http.Response{
+			Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+			StatusCode:    status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        w.header.Clone(),
+			ContentLength: -1,
+			Request:       w.r,
+		}
+		if n, err := strconv.ParseInt(w.header.Get("Content-Length"), 10, 64); err == nil {
+			res.ContentLength = n
+		}
+
+		// Collect the declared trailers...
+		w.trailer = http.Header{}
+		for _, v := range res.Header.Values("Trailer") {
+			for _, k := range strings.Split(v, ",") {
+				if k = http.CanonicalHeaderKey(strings.TrimSpace(k)); k != "" {
+					w.trailer[k] = nil
+				}
+			}
+		}
+		if len(w.trailer) > 0 {
+			res.Trailer = w.trailer.Clone()
+		}
+		res.Header.Del("Trailer")
+		res.Body = &pipeBody{PipeReader: w.pr, w: w, res: res}
+		w.res <- res
+	})
+}
+
+func (w *pipeWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.pw.Write(p)
+}
+
+// Flush does nothing, since writes block until they're read.
+func (w *pipeWriter) Flush() {}
+
+// finish sets the trailers the handler declared, and any it added
+// with the http.TrailerPrefix.
+func (w *pipeWriter) finish() {
+	for k := range w.trailer {
+		w.trailer[k] = w.header[k]
+	}
+	for k, vs := range w.header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			w.trailer[strings.TrimPrefix(k, http.TrailerPrefix)] = vs
+		}
+	}
+}
+
+// pipeBody is the body of a Middleware handler's response. Like the
+// body of a response from a server, its trailers are set once it's
+// been read.
+type pipeBody struct {
+	*io.PipeReader
+	w    *pipeWriter
+	res  *http.Response
+	once sync.Once
+}
+
+func (b *pipeBody) Read(p []byte) (int, error) {
+	n, err := b.PipeReader.Read(p)
+	if err == io.EOF {
+		b.once.Do(func() {
+			for k, vs := range b.w.trailer {
+				if b.res.Trailer == nil {
+					b.res.Trailer = http.Header{}
+				}
+				b.res.Trailer[k] = vs
+			}
+		})
+	}
+	return n, err
+}
+
+// fail ends the response with an error, or returns the error from
+// the round tripper if the headers haven't been written.
+func (w *pipeWriter) fail(err error) {
+	sent := true
+	w.once.Do(func() { sent = false })
+	if !sent {
+		w.errc <- err
+		return
+	}
+	w.pw.CloseWithError(err)
+}
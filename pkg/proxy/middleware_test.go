@@ -0,0 +1,113 @@
+package proxy_test
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/a-poor/red-tape/pkg/proxy"
+)
+
+func TestMiddleware(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Done")
+		w.Write([]byte(r.URL.Path))
+		w.Header().Set("X-Done", "yes")
+	})
+
+	tests := []struct {
+		name   string
+		faults proxy.Faults
+		status int
+		body   string
+	}{
+		{"none", proxy.Faults{}, http.StatusOK, "/hello"},
+		{"error", proxy.Faults{ProbError: 1, ErrorStatus: http.StatusTeapot}, http.StatusTeapot, "I'm a teapot\n"},
+	}
+	for _, tt := range tests {
+		mw, err := proxy.Middleware(&proxy.ProxyConfig{Faults: tt.faults})
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := httptest.NewServer(mw(h))
+		res, err := http.Get(srv.URL + "/hello")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		b, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		srv.Close()
+		if res.StatusCode != tt.status || string(b) != tt.body {
+			t.Errorf("%s: unexpected response %d %q", tt.name, res.StatusCode, b)
+		}
+		if tt.status == http.StatusOK && res.Trailer.Get("X-Done") != "yes" {
+			t.Errorf("%s: expected the handler's trailer, got %v", tt.name, res.Trailer)
+		}
+	}
+}
+
+func TestMiddlewareDrop(t *testing.T) {
+	mw, err := proxy.Middleware(&proxy.ProxyConfig{Faults: proxy.Faults{ProbDrop: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	called := false
+	srv := httptest.NewServer(mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})))
+	defer srv.Close()
+
+	if _, err := http.Get(srv.URL); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+	if called {
+		t.Error("expected the handler not to be called")
+	}
+}
+
+func TestMiddlewareStream(t *testing.T) {
+	var logs []*proxy.RequestLog
+	mw, err := proxy.Middleware(&proxy.ProxyConfig{
+		Faults:    proxy.Faults{Stream: &proxy.StreamConfig{ProbDropEvent: 1}},
+		Observers: []proxy.Observer{observerFunc(func(l *proxy.RequestLog) { logs = append(logs, l) })},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 3; i++ {
+			w.Write([]byte("data: hi\n\n"))
+			w.(http.Flusher).Flush()
+		}
+	})))
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := bufio.NewScanner(res.Body)
+	for s.Scan() {
+		if strings.HasPrefix(s.Text(), "data:") {
+			t.Errorf("expected every event to be dropped, got %q", s.Text())
+		}
+	}
+	res.Body.Close()
+
+	if len(logs) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(logs))
+	}
+	drops := 0
+	for _, d := range logs[0].Decisions() {
+		if d.Fault == proxy.FaultDropEvent {
+			drops++
+		}
+	}
+	if drops != 3 {
+		t.Errorf("expected 3 dropped events, got %d", drops)
+	}
+}
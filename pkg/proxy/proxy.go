@@ -1,130 +1,442 @@
 package proxy
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/charmbracelet/log"
-	"gonum.org/v1/gonum/stat/distuv"
+	"golang.org/x/exp/rand"
 )
 
 type ProxyConfig struct {
-	// The destination URL to which the request should be proxied
-	DestURL string
+	// The destination URL to which the request should be proxied.
+	// A "unix:///path/to.sock" URL proxies to a Unix socket.
+	DestURL string `mapstructure:"dest-url"`
 
+	// The default fault settings
+	Faults `mapstructure:",squash"`
+
+	// If the path is set, recorded responses are served instead of
+	// sending requests to the destination
+	Replay ReplayConfig `mapstructure:"replay"`
+
+	// Rules that override the default fault settings for matching
+	// destinations. The first matching rule is used.
+	Rules []Rule `mapstructure:"rules"`
+
+	// Limits on the requests in flight upstream
+	Concurrency ConcurrencyConfig `mapstructure:"concurrency"`
+
+	// If set, faults that replace the defaults while the proxy is
+	// running (e.g. from a Scenario)
+	Live *LiveFaults `mapstructure:"-"`
+
+	// Let clients set the faults for their requests with headers
+	ClientFaults ClientFaultsConfig `mapstructure:"client-faults"`
+
+	// Add headers (and trailers, for streamed responses) to responses
+	// describing the faults that were injected
+	AnnotateHeaders bool `mapstructure:"annotate-headers"`
+
+	// An optional seed for the random number generator
+	// (0 is treated as no seed)
+	Seed uint64 `mapstructure:"seed"`
+
+	// TLS settings for HTTPS upstreams. Only used if Transport
+	// isn't set.
+	UpstreamTLS *UpstreamTLSConfig `mapstructure:"upstream-tls"`
+
+	// If set, metrics are collected for every request
+	Metrics *Metrics `mapstructure:"-"`
+
+	// If set, a span is exported for every request
+	Tracer *Tracer `mapstructure:"-"`
+
+	// If set, every request and response is recorded
+	Recorder *Recorder `mapstructure:"-"`
+
+	// The faults run for each request, in order (defaults to
+	// DefaultPipeline). Custom faults can be added to the built-in
+	// ones, e.g. append(DefaultPipeline(), myFault).
+	Pipeline Pipeline `mapstructure:"-"`
+
+	// Observers passed every completed RequestLog (e.g. an AccessLog)
+	Observers []Observer `mapstructure:"-"`
+
+	// If not set, http.DefaultTransport is used.
+	Transport http.RoundTripper `mapstructure:"-"`
+
+	// Logger to use
+	Logger log.Logger `mapstructure:"-"`
+}
+
+// Faults are the settings for the faults injected into proxied
+// requests.
+type Faults struct {
 	// The probability of dropping a packet
-	ProbDrop float64
+	ProbDrop float64 `mapstructure:"prob-drop"`
 
 	// The rate of packet delay (sampled from an exponential
 	// distribution) before passing the request to the server
-	PreDelayRate float64
+	PreDelayRate float64 `mapstructure:"pre-delay-rate"`
 
 	// The maximum delay before passing the request to the server
-	PreDelayMax float64
+	PreDelayMax float64 `mapstructure:"pre-delay-max"`
 
 	// The rate of packet delay after receiving the response from
 	// the server, before passing it back to the client
-	PostDelayRate float64
+	PostDelayRate float64 `mapstructure:"post-delay-rate"`
 
 	// The maximum delay after receiving the response from the server,
 	// before passing it back to the client
-	PostDelayMax float64
+	PostDelayMax float64 `mapstructure:"post-delay-max"`
 
-	// An optional seed for the random number generator
-	// (0 is treated as no seed)
-	Seed uint64
+	// The probability of responding with an error status, instead of
+	// sending the request to the server
+	ProbError float64 `mapstructure:"prob-error"`
 
-	// If not set, http.DefaultTransport is used.
-	Transport http.RoundTripper
+	// The status to respond with for errors (defaults to 503)
+	ErrorStatus int `mapstructure:"error-status"`
 
-	// Logger to use
-	Logger log.Logger
+	// Latency that grows with the number of requests in flight
+	Load *LoadConfig `mapstructure:"load"`
+
+	// The probability of failing the request with a network error,
+	// instead of sending it to the server
+	ProbNetError float64 `mapstructure:"prob-net-error"`
+
+	// The kinds of network error to fail requests with, picked at
+	// random (e.g. NetErrorTimeout). Defaults to all of them.
+	NetErrors []string `mapstructure:"net-errors"`
+
+	// A state model for bursty faults. If set, the drop, delay and
+	// error faults come from the model's current state instead.
+	States *StateModel `mapstructure:"states"`
+
+	// Faults for streamed responses (e.g. Server-Sent Events)
+	Stream *StreamConfig `mapstructure:"stream"`
+
+	// Changes to the headers of requests and responses in flight
+	Headers []HeaderMutation `mapstructure:"headers"`
+
+	// Changes to the JSON of application/json responses
+	JSON []JSONMutation `mapstructure:"json"`
+
+	// Redirects (including redirect loops), instead of sending the
+	// request to the server
+	Redirect *RedirectConfig `mapstructure:"redirect"`
 }
 
+// ErrDropped is returned by the round tripper when a request is
+// dropped.
+var ErrDropped = errors.New("red-tape: request dropped")
+
 func MakeRoundTripper(cfg *ProxyConfig) (http.RoundTripper, error) {
 	// Get the logger...
-	logger := cfg.Logger
-	if logger == nil {
-		logger = log.Default()
-	}
+	logger := cfg.logger()
 
 	// Get the transport or use the default...
-	t := cfg.Transport
-	if t == nil {
-		t = http.DefaultTransport
+	t, err := makeTransport(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// ...and serve recorded responses, if replaying...
+	if cfg.Replay.Path != "" {
+		if t, err = makeReplayTransport(&cfg.Replay, t); err != nil {
+			return nil, err
+		}
 	}
 
-	// Create the pre- and post-request delay rng...
-	preRng := distuv.Exponential{
-		Rate: cfg.PreDelayRate,
+	// Check the faults...
+	if err := cfg.validateFaults(); err != nil {
+		return nil, err
+	}
+	chains := newStateChains()
+	exprs := newExprState(cfg.rulesReadBody())
+	var inFlight int64
+	pipeline := cfg.Pipeline
+	if pipeline == nil {
+		pipeline = DefaultPipeline()
 	}
-	postRng := distuv.Exponential{
-		Rate: cfg.PostDelayRate,
+
+	// Create the concurrency limiter...
+	lim, err := makeLimiter(&cfg.Concurrency)
+	if err != nil {
+		return nil, err
 	}
 
-	// Create the pre- and post-request delay functions...
-	preDelay := func() time.Duration {
-		// If the rate is <= 0, return 0...
-		if cfg.PreDelayRate <= 0 {
-			return 0
+	// Read the client fault settings...
+	cr, err := makeClientFaultReader(&cfg.ClientFaults)
+	if err != nil {
+		return nil, err
+	}
+
+	// Return the http.RoundTripper...
+	src := newSource(cfg.Seed)
+	return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		logger.Debug("Incoming request.", "method", r.Method, "url", r.URL)
+
+		// Find the faults for the request...
+		env, r := exprs.env(r)
+		rule, f := cfg.matchRequest(r, env)
+
+		// ...or the faults the client set...
+		cf, r2, cerr := cr.read(r)
+		if r2 != nil {
+			r = r2
+		}
+		if cf != nil || cerr != nil {
+			rule, f = RuleClient, &Faults{}
+		}
+		if cf == nil {
+			cf = &clientFaults{}
 		}
 
-		// Otherwise, generate a random number...
-		s := preRng.Rand()
+		// Start tracking the request...
+		rl, r := startRequestLog(r, rule)
+		done := cfg.Metrics.track()
+		atomic.AddInt64(&inFlight, 1)
+		var trailers, release func()
+		var ok bool
+		var recd *recording
+		finish := func() {
+			done()
+			atomic.AddInt64(&inFlight, -1)
+			if release != nil {
+				release()
+			}
+			if trailers != nil {
+				trailers()
+			}
+			rl.Duration = time.Since(rl.Start)
+			if recd != nil {
+				if err := cfg.Recorder.record(rl, recd); err != nil {
+					logger.Error("Failed to record request.", "err", err)
+				}
+			}
+			cfg.observe(rl)
+		}
+		if r.Body != nil {
+			r.Body = &countingBody{ReadCloser: r.Body, n: &rl.BytesIn}
+		}
+		if cfg.Tracer != nil {
+			r = cfg.Tracer.start(rl, r)
+		}
+		if cfg.Recorder != nil {
+			recd, r = cfg.Recorder.start(r)
+		}
+		if cerr != nil {
+			logger.Debug("Invalid client fault headers.", "err", cerr)
+			resp := makeResponse(r, http.StatusBadRequest, "red-tape: "+cerr.Error())
+			rl.Status = resp.StatusCode
+			resp.Body = &countingBody{ReadCloser: resp.Body, n: &rl.BytesOut, onClose: finish}
+			return resp, nil
+		}
 
-		// If it's greater than the max, clamp it...
-		if s > cfg.PreDelayMax {
-			s = cfg.PreDelayMax
+		// Move the state model on...
+		if f.States != nil {
+			s := chains.step(src, f.States, clientIP(r.RemoteAddr), r.URL.Host)
+			logger.Debug("Moved state.", "state", s.Name)
+			rl.decide(Decision{Fault: FaultState, Value: s.Name})
+			f = f.withState(s)
 		}
 
-		// Convert to milliseconds and return...
-		return time.Duration(s) * time.Millisecond
-	}
-	postDelay := func() time.Duration {
-		// If the rate is <= 0, return 0...
-		if cfg.PostDelayRate <= 0 {
-			return 0
+		// Run the faults before the request...
+		fc := &FaultContext{
+			Faults:   f,
+			Rule:     rule,
+			Log:      rl,
+			Logger:   logger,
+			Rand:     rand.New(src),
+			src:      src,
+			client:   cf,
+			inFlight: &inFlight,
+		}
+		resp, err := pipeline.beforeRequest(fc, r)
+		if err != nil {
+			rl.Err = err
+			closeBody(r)
+			finish()
+			return nil, err
 		}
 
-		// Otherwise, generate a random number...
-		s := postRng.Rand()
+		// ...and, unless they responded, send the request...
+		if resp != nil {
+			closeBody(r)
+		} else if release, ok = lim.acquire(r.Context(), rl); !ok {
+			logger.Debug("Rejecting queued request.", "upstream", r.URL.Host)
+			resp = makeResponse(r, http.StatusServiceUnavailable, http.StatusText(http.StatusServiceUnavailable))
+			closeBody(r)
+		} else {
+			logger.Debug("Sending request.", "upstream", r.URL.Host)
+			sent := time.Now()
+			resp, err = t.RoundTrip(r)
+			rl.UpstreamLatency = time.Since(sent)
+			rl.phase(PhaseUpstream, sent, sent.Add(rl.UpstreamLatency))
+			if err != nil {
+				rl.Err = err
+				finish()
+				return nil, err
+			}
+
+			// Record the response as the upstream sent it, before
+			// any faults change it...
+			if recd != nil {
+				recd.response(resp, cfg.Recorder.maxBody)
+			}
+		}
+		rl.Status = resp.StatusCode
 
-		// If it's greater than the max, clamp it...
-		if s > cfg.PostDelayMax {
-			s = cfg.PostDelayMax
+		// Run the faults after the response...
+		pipeline.afterResponse(fc, resp)
+		resp.Body = &countingBody{ReadCloser: resp.Body, n: &rl.BytesOut, onClose: finish}
+
+		// Describe the faults...
+		if cfg.AnnotateHeaders {
+			trailers = annotateHeaders(resp, rl)
 		}
 
-		// Convert to milliseconds and return...
-		return time.Duration(s) * time.Millisecond
+		// Return the (possibly faulted) response...
+		logger.Debug("Returning response to client.")
+		return resp, nil
+	}), nil
+}
+
+// validate checks the faults' models and options.
+func (f *Faults) validate() error {
+	if f.ErrorStatus != 0 && (f.ErrorStatus < 100 || f.ErrorStatus > 599) {
+		return fmt.Errorf("invalid error status %d", f.ErrorStatus)
+	}
+	if f.States != nil {
+		if err := f.States.Validate(); err != nil {
+			return err
+		}
+		for i := range f.States.States {
+			s := &f.States.States[i]
+			if err := s.Faults.validate(); err != nil {
+				return fmt.Errorf("state %q: %w", s.Name, err)
+			}
+		}
+	}
+	if f.Load != nil {
+		if err := f.Load.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, k := range f.NetErrors {
+		switch k {
+		case NetErrorTimeout, NetErrorConnReset, NetErrorConnRefused, NetErrorDNS:
+		default:
+			return fmt.Errorf("unknown network error %q", k)
+		}
+	}
+	for i := range f.Headers {
+		if err := f.Headers[i].Validate(); err != nil {
+			return err
+		}
+	}
+	for i := range f.JSON {
+		if err := f.JSON[i].Validate(); err != nil {
+			return err
+		}
 	}
+	if f.Redirect != nil {
+		if err := f.Redirect.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	// Return the http.RoundTripper...
-	return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
-		logger.Info("Incoming request")
+// Validate checks the default faults and the rules, including their
+// expressions.
+func (cfg *ProxyConfig) Validate() error {
+	return cfg.validateFaults()
+}
 
-		// Sleep before...
-		d := preDelay()
-		logger.Debug("Sleeping for %s before request.", d)
-		time.Sleep(d)
+// validateFaults checks the default faults and each rule's faults,
+// compiling the rules' expressions.
+func (cfg *ProxyConfig) validateFaults() error {
+	if err := cfg.Faults.validate(); err != nil {
+		return err
+	}
+	for i := range cfg.Rules {
+		r := &cfg.Rules[i]
+		if err := r.Faults.validate(); err != nil {
+			return fmt.Errorf("rule %q: %w", r.Name, err)
+		}
+		if err := r.compile(); err != nil {
+			return fmt.Errorf("rule %q: %w", r.Name, err)
+		}
+	}
+	return nil
+}
 
-		// Should the request be dropped?
-		// TODO - Fill this in...
+// rulesReadBody returns true if any rule's expressions read the
+// request body.
+func (cfg *ProxyConfig) rulesReadBody() bool {
+	for i := range cfg.Rules {
+		if cfg.Rules[i].readsBody() {
+			return true
+		}
+	}
+	return false
+}
 
-		// Send the request...
-		logger.Debug("Sending request to %q", cfg.DestURL)
-		resp, err := t.RoundTrip(r)
+// errorStatus returns the status to respond with for error faults.
+func (f *Faults) errorStatus() int {
+	if f.ErrorStatus == 0 {
+		return http.StatusServiceUnavailable
+	}
+	return f.ErrorStatus
+}
 
-		// Sleep after...
-		d = postDelay()
-		logger.Debug("Sleeping for %s after response returned.", d)
-		time.Sleep(d)
+// closeBody closes a request's body, if it has one.
+func closeBody(r *http.Request) {
+	if r.Body != nil {
+		r.Body.Close()
+	}
+}
 
-		// Return the results, unchanged...
-		logger.Debug("Returning response to client.")
-		return resp, err
-	}), nil
+// makeResponse creates a response to r, generated by red-tape rather
+// than the upstream.
+func makeResponse(r *http.Request, status int, body string) *http.Response {
+	body += "\n"
+	return &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       r,
+	}
+}
+
+// observe passes a completed RequestLog to the configured observers.
+func (cfg *ProxyConfig) observe(l *RequestLog) {
+	if cfg.Metrics != nil {
+		cfg.Metrics.Observe(l)
+	}
+	if cfg.Tracer != nil {
+		cfg.Tracer.Observe(l)
+	}
+	for _, o := range cfg.Observers {
+		o.Observe(l)
+	}
 }
 
 func MakeProxy(cfg *ProxyConfig) (*httputil.ReverseProxy, error) {
@@ -134,6 +446,12 @@ func MakeProxy(cfg *ProxyConfig) (*httputil.ReverseProxy, error) {
 		return nil, err
 	}
 
+	// Requests to a Unix socket upstream are sent over plain http,
+	// and the transport dials the socket...
+	if _, ok := unixSocketPath(cfg.DestURL); ok {
+		u = &url.URL{Scheme: "http", Host: "localhost"}
+	}
+
 	// Create the http transport...
 	rt, err := MakeRoundTripper(cfg)
 	if err != nil {
@@ -146,10 +464,62 @@ func MakeProxy(cfg *ProxyConfig) (*httputil.ReverseProxy, error) {
 		Rewrite: func(r *httputil.ProxyRequest) {
 			r.SetURL(u)
 			r.Out.Host = r.In.Host
+			r.Out = r.Out.WithContext(context.WithValue(r.Out.Context(), inboundKey{}, r.In.URL))
 		},
+		ErrorHandler: makeErrorHandler(cfg.logger()),
 	}, nil
 }
 
+// makeErrorHandler creates the error handler for a ReverseProxy.
+// Dropped requests close the client's connection without a response.
+func makeErrorHandler(logger log.Logger) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		if errors.Is(err, ErrDropped) {
+			panic(http.ErrAbortHandler)
+		}
+		logger.Error("Proxy error.", "err", err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+}
+
+// logger returns the configured logger or the default logger.
+func (cfg *ProxyConfig) logger() log.Logger {
+	if cfg.Logger == nil {
+		return log.Default()
+	}
+	return cfg.Logger
+}
+
+// makeTransport returns the transport used to send requests upstream.
+func makeTransport(cfg *ProxyConfig) (http.RoundTripper, error) {
+	if cfg.Transport != nil {
+		return cfg.Transport, nil
+	}
+	sock, unix := unixSocketPath(cfg.DestURL)
+	if cfg.UpstreamTLS == nil && !unix {
+		return http.DefaultTransport, nil
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+
+	// Configure the transport's TLS...
+	if cfg.UpstreamTLS != nil {
+		tc, err := MakeUpstreamTLSConfig(cfg.UpstreamTLS)
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig = tc
+	}
+
+	// Dial the upstream's Unix socket, whatever the request's host...
+	if unix {
+		var d net.Dialer
+		t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return d.DialContext(ctx, "unix", sock)
+		}
+	}
+	return t, nil
+}
+
 type roundTripperFunc func(*http.Request) (*http.Response, error)
 
 func (rt roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
@@ -1 +1,68 @@
 package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/a-poor/red-tape/pkg/proxy"
+)
+
+func TestErrorStatusValidate(t *testing.T) {
+	tests := []struct {
+		faults proxy.Faults
+		ok     bool
+	}{
+		{proxy.Faults{ProbError: 1}, true},
+		{proxy.Faults{ProbError: 1, ErrorStatus: http.StatusTeapot}, true},
+		{proxy.Faults{ProbError: 1, ErrorStatus: 42}, false},
+		{proxy.Faults{ProbError: 1, ErrorStatus: 600}, false},
+		{proxy.Faults{States: &proxy.StateModel{States: []proxy.State{
+			{Name: "bad", Faults: proxy.Faults{ErrorStatus: 1000}},
+		}}}, false},
+	}
+	for _, tt := range tests {
+		_, err := proxy.MakeRoundTripper(&proxy.ProxyConfig{Faults: tt.faults})
+		if (err == nil) != tt.ok {
+			t.Errorf("%+v: unexpected error %v", tt.faults, err)
+		}
+	}
+}
+
+func TestDelayMax(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+
+	tests := []struct {
+		max  float64
+		want time.Duration
+	}{
+		{0, 0},
+		{-1, 0},
+		{2, 2 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		// With a rate this low, every delay is clamped to the max...
+		var d time.Duration
+		rt, err := proxy.MakeRoundTripper(&proxy.ProxyConfig{
+			DestURL: up.URL,
+			Faults:  proxy.Faults{PreDelayRate: 1e-9, PreDelayMax: tt.max},
+			Observers: []proxy.Observer{observerFunc(func(l *proxy.RequestLog) {
+				d = l.AddedDelay()
+			})},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest(http.MethodGet, up.URL+"/", nil)
+		res, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if d != tt.want {
+			t.Errorf("max %v: expected a delay of %s, got %s", tt.max, tt.want, d)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/exp/rand"
+	"gonum.org/v1/gonum/stat/distuv"
+)
+
+// lockedSource wraps a rand.Source so it can be shared by requests
+// being handled concurrently.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Uint64()
+}
+
+func (s *lockedSource) Seed(seed uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
+
+// newSource creates a concurrency-safe random source. A seed of 0 is
+// treated as no seed, in which case the current time is used.
+func newSource(seed uint64) rand.Source {
+	if seed == 0 {
+		seed = uint64(time.Now().UnixNano())
+	}
+	return &lockedSource{src: rand.NewSource(seed)}
+}
+
+// sampleDelay samples a delay (in milliseconds) from an exponential
+// distribution with the given rate, clamped to max. A rate <= 0 or a
+// max <= 0 means no delay.
+func sampleDelay(src rand.Source, rate, max float64) time.Duration {
+	// If the rate or max is <= 0, return 0...
+	if rate <= 0 || max <= 0 {
+		return 0
+	}
+
+	// Otherwise, generate a random number...
+	s := distuv.Exponential{Rate: rate, Src: src}.Rand()
+
+	// If it's greater than the max, clamp it...
+	if s > max {
+		s = max
+	}
+
+	// Convert to milliseconds and return...
+	return time.Duration(s * float64(time.Millisecond))
+}
+
+// sampleProb returns true with probability p.
+func sampleProb(src rand.Source, p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	if p >= 1 {
+		return true
+	}
+	return rand.New(src).Float64() < p
+}
@@ -0,0 +1,369 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// The recording formats.
+const (
+	RecordHAR   = "har"
+	RecordJSONL = "jsonl"
+)
+
+// DefaultRecordMaxBody is the default cap on the body bytes recorded
+// for each request and response.
+const DefaultRecordMaxBody = 1 << 20
+
+// DefaultRedactHeaders are the headers redacted from recordings by
+// default.
+var DefaultRedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+// redacted replaces the values of redacted headers.
+const redacted = "REDACTED"
+
+// RecordConfig configures recording proxied traffic.
+type RecordConfig struct {
+	// The file to record to
+	Path string `mapstructure:"path"`
+
+	// The format, either RecordHAR or RecordJSONL (one HAR entry per
+	// line). Defaults to RecordHAR for ".har" files and RecordJSONL
+	// otherwise.
+	Format string `mapstructure:"format"`
+
+	// The maximum body bytes recorded for each request and response
+	// (defaults to DefaultRecordMaxBody, and < 0 records no bodies)
+	MaxBodyBytes int `mapstructure:"max-body-bytes"`
+
+	// Headers whose values are redacted (defaults to
+	// DefaultRedactHeaders)
+	RedactHeaders []string `mapstructure:"redact-headers"`
+}
+
+// Recorder records each request and response passing through the
+// proxy, with its timings and the faults injected into it, as HAR
+// entries.
+type Recorder struct {
+	format  string
+	maxBody int
+	redact  map[string]bool
+
+	mu sync.Mutex
+	f  *os.File
+	n  int
+}
+
+// MakeRecorder creates a Recorder, creating its file.
+func MakeRecorder(cfg *RecordConfig) (*Recorder, error) {
+	format := cfg.Format
+	switch format {
+	case "":
+		format = RecordJSONL
+		if strings.EqualFold(filepath.Ext(cfg.Path), ".har") {
+			format = RecordHAR
+		}
+	case RecordHAR, RecordJSONL:
+	default:
+		return nil, fmt.Errorf("unknown record format %q", format)
+	}
+	rec := &Recorder{format: format, maxBody: cfg.MaxBodyBytes, redact: map[string]bool{}}
+	if rec.maxBody == 0 {
+		rec.maxBody = DefaultRecordMaxBody
+	}
+	hs := cfg.RedactHeaders
+	if hs == nil {
+		hs = DefaultRedactHeaders
+	}
+	for _, h := range hs {
+		rec.redact[http.CanonicalHeaderKey(h)] = true
+	}
+
+	// Create the file...
+	f, err := os.Create(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	rec.f = f
+	if format == RecordHAR {
+		_, err = io.WriteString(f, `{"log":{"version":"1.2","creator":{"name":"red-tape","version":"1"},"entries":[`+"\n")
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return rec, nil
+}
+
+// Close finishes the recording and closes its file.
+func (rec *Recorder) Close() error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.format == RecordHAR {
+		if _, err := io.WriteString(rec.f, "\n]}}\n"); err != nil {
+			rec.f.Close()
+			return err
+		}
+	}
+	return rec.f.Close()
+}
+
+// recording is a request and response being recorded. Only
+// responses from the upstream are recorded, as they were received:
+// the faults injected are recorded separately.
+type recording struct {
+	req     *http.Request
+	reqBody *captureBody
+
+	status  int // The upstream's status (0 if there's no response)
+	proto   string
+	header  http.Header
+	resBody *captureBody
+}
+
+// start starts recording r, returning a copy of r whose body is
+// captured as it's read.
+func (rec *Recorder) start(r *http.Request) (*recording, *http.Request) {
+	rc := &recording{req: r}
+	if r.Body != nil && r.Body != http.NoBody {
+		r2 := new(http.Request)
+		*r2 = *r
+		rc.reqBody = &captureBody{ReadCloser: r.Body, max: rec.maxBody}
+		r2.Body = rc.reqBody
+		r = r2
+	}
+	return rc, r
+}
+
+// response captures res's status and headers, and its body as it's
+// read.
+func (rc *recording) response(res *http.Response, max int) {
+	rc.status = res.StatusCode
+	rc.proto = res.Proto
+	rc.header = res.Header.Clone()
+	rc.resBody = &captureBody{ReadCloser: res.Body, max: max}
+	res.Body = rc.resBody
+}
+
+// record writes the entry for a completed request.
+func (rec *Recorder) record(l *RequestLog, rc *recording) error {
+	e := harEntry{
+		Started: l.Start,
+		Time:    ms(l.Duration),
+		Request: harRequest{
+			Method:      l.Method,
+			URL:         l.URL,
+			HTTPVersion: rc.req.Proto,
+			Headers:     rec.headers(rc.req.Header),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Response: harResponse{
+			HTTPVersion: "HTTP/1.1",
+			Headers:     []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Cache: struct{}{},
+		Rule:  l.Rule,
+	}
+	for k, vs := range rc.req.URL.Query() {
+		for _, v := range vs {
+			e.Request.QueryString = append(e.Request.QueryString, harNameValue{Name: k, Value: v})
+		}
+	}
+	sort.Slice(e.Request.QueryString, func(i, j int) bool {
+		return e.Request.QueryString[i].Name < e.Request.QueryString[j].Name
+	})
+	if rc.reqBody != nil {
+		e.Request.BodySize = rc.reqBody.n
+		text, enc := rc.reqBody.text()
+		e.Request.PostData = &harPostData{
+			MimeType:  rc.req.Header.Get("Content-Type"),
+			Text:      text,
+			Encoding:  enc,
+			Truncated: rc.reqBody.truncated(),
+		}
+	}
+	if rc.status != 0 {
+		e.Response.Status = rc.status
+		e.Response.StatusText = http.StatusText(rc.status)
+		e.Response.HTTPVersion = rc.proto
+		e.Response.Headers = rec.headers(rc.header)
+		e.Response.BodySize = rc.resBody.n
+		text, enc := rc.resBody.text()
+		e.Response.Content = harContent{
+			Size:      rc.resBody.n,
+			MimeType:  rc.header.Get("Content-Type"),
+			Text:      text,
+			Encoding:  enc,
+			Truncated: rc.resBody.truncated(),
+		}
+	}
+	if l.Err != nil {
+		e.Error = l.Err.Error()
+	}
+
+	// Split the time between the delays, waiting for the upstream
+	// and receiving the body...
+	var blocked time.Duration
+	for _, d := range l.Decisions() {
+		if d.Fault != FaultPostDelay {
+			blocked += d.Delay
+		}
+		e.Faults = append(e.Faults, accessFault{Fault: d.Fault, Value: d.Value})
+		if d.Delay > 0 {
+			e.Faults[len(e.Faults)-1].Delay = d.Delay.String()
+		}
+	}
+	e.Timings = harTimings{
+		Blocked: ms(blocked),
+		Wait:    ms(l.UpstreamLatency),
+		Receive: ms(l.Duration - blocked - l.UpstreamLatency),
+	}
+	if e.Timings.Receive < 0 {
+		e.Timings.Receive = 0
+	}
+
+	// Write it...
+	b, err := json.Marshal(&e)
+	if err != nil {
+		return err
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.format == RecordHAR && rec.n > 0 {
+		if _, err := rec.f.Write([]byte(",\n")); err != nil {
+			return err
+		}
+	}
+	rec.n++
+	if rec.format == RecordJSONL {
+		b = append(b, '\n')
+	}
+	_, err = rec.f.Write(b)
+	return err
+}
+
+// headers converts headers to HAR, redacting secrets.
+func (rec *Recorder) headers(h http.Header) []harNameValue {
+	nvs := []harNameValue{}
+	for _, k := range sortedKeys(h) {
+		for _, v := range h[k] {
+			if rec.redact[http.CanonicalHeaderKey(k)] {
+				v = redacted
+			}
+			nvs = append(nvs, harNameValue{Name: k, Value: v})
+		}
+	}
+	return nvs
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// captureBody keeps a copy of up to max bytes read from a body. A
+// max < 0 keeps nothing.
+type captureBody struct {
+	io.ReadCloser
+	max int
+	buf bytes.Buffer
+	n   int64
+}
+
+func (b *captureBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if room := b.max - b.buf.Len(); room > 0 {
+		if room > n {
+			room = n
+		}
+		b.buf.Write(p[:room])
+	}
+	return n, err
+}
+
+func (b *captureBody) truncated() bool {
+	return int64(b.buf.Len()) < b.n
+}
+
+// text returns the captured body as HAR text, base64 encoding it if
+// it isn't valid UTF-8.
+func (b *captureBody) text() (string, string) {
+	if utf8.Valid(b.buf.Bytes()) {
+		return b.buf.String(), ""
+	}
+	return base64.StdEncoding.EncodeToString(b.buf.Bytes()), "base64"
+}
+
+// The HAR 1.2 types used for recordings, with red-tape's additions
+// prefixed with an underscore.
+type (
+	harEntry struct {
+		Started  time.Time     `json:"startedDateTime"`
+		Time     float64       `json:"time"`
+		Request  harRequest    `json:"request"`
+		Response harResponse   `json:"response"`
+		Cache    struct{}      `json:"cache"`
+		Timings  harTimings    `json:"timings"`
+		Rule     string        `json:"_rule,omitempty"`
+		Error    string        `json:"_error,omitempty"`
+		Faults   []accessFault `json:"_faults,omitempty"`
+	}
+	harRequest struct {
+		Method      string         `json:"method"`
+		URL         string         `json:"url"`
+		HTTPVersion string         `json:"httpVersion"`
+		Headers     []harNameValue `json:"headers"`
+		QueryString []harNameValue `json:"queryString"`
+		PostData    *harPostData   `json:"postData,omitempty"`
+		HeadersSize int            `json:"headersSize"`
+		BodySize    int64          `json:"bodySize"`
+	}
+	harResponse struct {
+		Status      int            `json:"status"`
+		StatusText  string         `json:"statusText"`
+		HTTPVersion string         `json:"httpVersion"`
+		Headers     []harNameValue `json:"headers"`
+		Content     harContent     `json:"content"`
+		RedirectURL string         `json:"redirectURL"`
+		HeadersSize int            `json:"headersSize"`
+		BodySize    int64          `json:"bodySize"`
+	}
+	harNameValue struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	harPostData struct {
+		MimeType  string `json:"mimeType"`
+		Text      string `json:"text"`
+		Encoding  string `json:"_encoding,omitempty"`
+		Truncated bool   `json:"_truncated,omitempty"`
+	}
+	harContent struct {
+		Size      int64  `json:"size"`
+		MimeType  string `json:"mimeType"`
+		Text      string `json:"text"`
+		Encoding  string `json:"encoding,omitempty"`
+		Truncated bool   `json:"_truncated,omitempty"`
+	}
+	harTimings struct {
+		Blocked float64 `json:"blocked"`
+		Send    float64 `json:"send"`
+		Wait    float64 `json:"wait"`
+		Receive float64 `json:"receive"`
+	}
+)
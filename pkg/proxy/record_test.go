@@ -0,0 +1,185 @@
+package proxy_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/a-poor/red-tape/pkg/proxy"
+)
+
+func TestRecordHAR(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer up.Close()
+
+	path := filepath.Join(t.TempDir(), "out.har")
+	rec, err := proxy.MakeRecorder(&proxy.RecordConfig{Path: path, MaxBodyBytes: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := proxy.MakeProxy(&proxy.ProxyConfig{
+		DestURL:  up.URL,
+		Faults:   proxy.Faults{PreDelayRate: 1, PreDelayMax: 1},
+		Recorder: rec,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/echo?a=1", strings.NewReader("hello"))
+		req.Header.Set("Authorization", "Bearer secret")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read the recording back...
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var har struct {
+		Log struct {
+			Entries []struct {
+				Request struct {
+					Method   string
+					Headers  []struct{ Name, Value string }
+					PostData struct{ Text string }
+				}
+				Response struct {
+					Status  int
+					Content struct {
+						Size      int64
+						Text      string
+						Truncated bool `json:"_truncated"`
+					}
+				}
+				Faults []struct{ Fault string } `json:"_faults"`
+			}
+		}
+	}
+	if err := json.Unmarshal(b, &har); err != nil {
+		t.Fatalf("invalid HAR: %v\n%s", err, b)
+	}
+	if len(har.Log.Entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(har.Log.Entries))
+	}
+	e := har.Log.Entries[0]
+	if e.Request.Method != http.MethodPost || e.Request.PostData.Text != "hell" {
+		t.Errorf("unexpected request %+v", e.Request)
+	}
+	for _, h := range e.Request.Headers {
+		if h.Name == "Authorization" && h.Value != "REDACTED" {
+			t.Errorf("expected Authorization to be redacted, got %q", h.Value)
+		}
+	}
+	c := e.Response.Content
+	if e.Response.Status != http.StatusOK || c.Text != "hell" || c.Size != 5 || !c.Truncated {
+		t.Errorf("unexpected response %+v", e.Response)
+	}
+	if len(e.Faults) == 0 || e.Faults[0].Fault != proxy.FaultPreDelay {
+		t.Errorf("expected a pre-delay fault, got %+v", e.Faults)
+	}
+}
+
+func TestRecordUpstreamResponse(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Up", "1")
+		w.Write([]byte(`{"a":1,"b":2}`))
+	}))
+	defer up.Close()
+
+	path := filepath.Join(t.TempDir(), "out.jsonl")
+	rec, err := proxy.MakeRecorder(&proxy.RecordConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt, err := proxy.MakeRoundTripper(&proxy.ProxyConfig{
+		Rules: []proxy.Rule{{
+			Name:   "error",
+			When:   `path == "/error"`,
+			Faults: proxy.Faults{ProbError: 1},
+		}},
+		Faults: proxy.Faults{
+			Headers: []proxy.HeaderMutation{{Op: proxy.HeaderOpStrip, Header: "X-Up", Prob: 1}},
+			JSON:    []proxy.JSONMutation{{Op: proxy.JSONOpDelete, Path: "$.b", Prob: 1}},
+		},
+		Recorder: rec,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/ok", "/error"} {
+		req, _ := http.NewRequest(http.MethodGet, up.URL+p, nil)
+		res, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The upstream's response is recorded, not the mutated one...
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(lines))
+	}
+	type entry struct {
+		Response struct {
+			Status  int
+			Headers []struct{ Name, Value string }
+			Content struct{ Text string }
+		}
+		Faults []struct{ Fault string } `json:"_faults"`
+	}
+	var e entry
+	if err := json.Unmarshal([]byte(lines[0]), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Response.Content.Text != `{"a":1,"b":2}` {
+		t.Errorf("expected the upstream's body, got %q", e.Response.Content.Text)
+	}
+	found := false
+	for _, h := range e.Response.Headers {
+		found = found || h.Name == "X-Up"
+	}
+	if !found {
+		t.Error("expected the upstream's X-Up header to be recorded")
+	}
+	if len(e.Faults) != 2 {
+		t.Errorf("expected the header and JSON faults to be recorded, got %+v", e.Faults)
+	}
+
+	// ...and injected errors have no response.
+	e = entry{}
+	if err := json.Unmarshal([]byte(lines[1]), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Response.Status != 0 || len(e.Faults) != 1 || e.Faults[0].Fault != proxy.FaultError {
+		t.Errorf("expected only the injected error to be recorded, got %+v", e)
+	}
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// RedirectHopParam is the query parameter counting the hops of a
+// redirect loop. It's removed before the request is sent upstream.
+const RedirectHopParam = "red-tape-hop"
+
+// RedirectDeadHost is a Location on a host that never resolves, to
+// redirect clients to a dead host.
+const RedirectDeadHost = "http://dead.red-tape.invalid/"
+
+// inboundKey is the context key for the URL a reverse-proxied request
+// was received with, before it was rewritten for the upstream.
+type inboundKey struct{}
+
+// RedirectConfig configures responding to requests with redirects,
+// instead of sending them upstream.
+type RedirectConfig struct {
+	// The probability of redirecting a request
+	Prob float64 `mapstructure:"prob"`
+
+	// The status to redirect with: 301, 302 (the default), 303, 307
+	// or 308
+	Status int `mapstructure:"status"`
+
+	// Where to redirect to. A relative location (like "/login") is
+	// resolved by the client against red-tape's URL, so it comes
+	// back through red-tape to the upstream, and an absolute one can
+	// send the client to another host (e.g. RedirectDeadHost). If
+	// empty, the client is redirected back to the URL it requested,
+	// in a loop.
+	Location string `mapstructure:"location"`
+
+	// For loops, the number of redirects before the request is sent
+	// upstream (0 means the loop never ends)
+	Hops int `mapstructure:"hops"`
+
+	// The delay before each redirect (ms)
+	Delay float64 `mapstructure:"delay"`
+}
+
+// Validate checks the redirect's settings.
+func (c *RedirectConfig) Validate() error {
+	switch c.Status {
+	case 0, http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		return fmt.Errorf("invalid redirect status %d", c.Status)
+	}
+	if _, err := url.Parse(c.Location); err != nil {
+		return fmt.Errorf("invalid redirect location: %w", err)
+	}
+	return nil
+}
+
+// redirectFault responds with redirects.
+type redirectFault struct{ NopFault }
+
+func (redirectFault) BeforeRequest(fc *FaultContext, r *http.Request) (*http.Response, error) {
+	c := fc.Faults.Redirect
+	if c == nil {
+		return nil, nil
+	}
+
+	// Requests in a loop keep being redirected, until they've made
+	// enough hops...
+	q := r.URL.Query()
+	hop, err := strconv.Atoi(q.Get(RedirectHopParam))
+	loop := c.Location == "" && err == nil
+	if loop && c.Hops > 0 && hop >= c.Hops {
+		fc.Logger.Debug("Ending redirect loop.", "hops", hop)
+		q.Del(RedirectHopParam)
+		u := *r.URL
+		u.RawQuery = q.Encode()
+		r.URL = &u
+		return nil, nil
+	}
+	if !loop && !fc.SampleProb(c.Prob) {
+		return nil, nil
+	}
+
+	// ...back to the URL the client requested (not the upstream's,
+	// which may have the DestURL's path joined on), with the hop
+	// counted...
+	loc := c.Location
+	if loc == "" {
+		in := r.URL
+		if u, ok := r.Context().Value(inboundKey{}).(*url.URL); ok {
+			in = u
+		}
+		q := in.Query()
+		q.Set(RedirectHopParam, strconv.Itoa(hop+1))
+		u := url.URL{Path: in.Path, RawPath: in.RawPath, RawQuery: q.Encode()}
+		loc = u.String()
+	}
+
+	// ...or to the configured location.
+	d := time.Duration(c.Delay * float64(time.Millisecond))
+	fc.Logger.Debug("Redirecting request.", "rule", fc.Rule, "location", loc, "delay", d)
+	fc.Sleep(FaultRedirectDelay, PhaseRedirectDelay, d)
+	status := c.Status
+	if status == 0 {
+		status = http.StatusFound
+	}
+	fc.Decide(Decision{Fault: FaultRedirect, Value: loc})
+	res := makeResponse(r, status, http.StatusText(status))
+	res.Header.Set("Location", loc)
+	return res, nil
+}
@@ -0,0 +1,129 @@
+package proxy_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/a-poor/red-tape/pkg/proxy"
+)
+
+func TestRedirectLoop(t *testing.T) {
+	var gotQuery string
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.RawQuery
+	}))
+	defer up.Close()
+
+	newProxy := func(c proxy.RedirectConfig) *httptest.Server {
+		p, err := proxy.MakeProxy(&proxy.ProxyConfig{
+			DestURL: up.URL,
+			Faults:  proxy.Faults{Redirect: &c},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return httptest.NewServer(p)
+	}
+
+	// A loop with a limited number of hops ends at the upstream...
+	srv := newProxy(proxy.RedirectConfig{Prob: 1, Hops: 3, Delay: 1})
+	defer srv.Close()
+	var hops int
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		hops = len(via)
+		return nil
+	}}
+	res, err := client.Get(srv.URL + "/a?b=c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || hops != 3 {
+		t.Errorf("expected 3 redirects and a 200, got %d redirects and a %d", hops, res.StatusCode)
+	}
+	if gotQuery != "b=c" {
+		t.Errorf("expected the hop parameter to be removed, got query %q", gotQuery)
+	}
+
+	// ...and an endless one hits the client's limit.
+	srv2 := newProxy(proxy.RedirectConfig{Prob: 1, Status: http.StatusPermanentRedirect})
+	defer srv2.Close()
+	_, err = http.Get(srv2.URL)
+	if err == nil || !strings.Contains(err.Error(), "stopped after 10 redirects") {
+		t.Errorf("expected too many redirects, got %v", err)
+	}
+}
+
+func TestRedirectLoopBasePath(t *testing.T) {
+	var gotURL string
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotURL = r.URL.String()
+	}))
+	defer up.Close()
+
+	p, err := proxy.MakeProxy(&proxy.ProxyConfig{
+		DestURL: up.URL + "/api?k=v",
+		Faults:  proxy.Faults{Redirect: &proxy.RedirectConfig{Prob: 1, Hops: 2}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+
+	// The loop redirects to the path the client requested...
+	var locs []string
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		locs = append(locs, req.URL.RequestURI())
+		return nil
+	}}
+	res, err := client.Get(srv.URL + "/a?b=c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	want := []string{"/a?b=c&red-tape-hop=1", "/a?b=c&red-tape-hop=2"}
+	if strings.Join(locs, " ") != strings.Join(want, " ") {
+		t.Errorf("expected redirects to %v, got %v", want, locs)
+	}
+
+	// ...so the upstream gets the base path joined on only once.
+	if gotURL != "/api/a?b=c&k=v" {
+		t.Errorf("expected the upstream to get /api/a?b=c&k=v, got %s", gotURL)
+	}
+}
+
+func TestRedirectLocation(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+
+	rt, err := proxy.MakeRoundTripper(&proxy.ProxyConfig{
+		Faults: proxy.Faults{Redirect: &proxy.RedirectConfig{
+			Prob:     1,
+			Status:   http.StatusTemporaryRedirect,
+			Location: proxy.RedirectDeadHost,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: rt}
+	_, err = client.Get(up.URL)
+	var ue *url.Error
+	if !errors.As(err, &ue) || !strings.Contains(ue.URL, "red-tape.invalid") {
+		t.Errorf("expected the client to follow the redirect to the dead host, got %v", err)
+	}
+}
+
+func TestRedirectValidate(t *testing.T) {
+	_, err := proxy.MakeRoundTripper(&proxy.ProxyConfig{
+		Faults: proxy.Faults{Redirect: &proxy.RedirectConfig{Status: http.StatusOK}},
+	})
+	if err == nil {
+		t.Error("expected an error for a non-redirect status")
+	}
+}
@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// What to do with requests that don't match a recording.
+const (
+	ReplayFail = "fail"
+	ReplayPass = "pass"
+)
+
+// ReplayConfig configures serving recorded responses instead of
+// sending requests upstream.
+type ReplayConfig struct {
+	// The recording to replay, as written by a Recorder (HAR or
+	// JSONL)
+	Path string `mapstructure:"path"`
+
+	// Match requests on a hash of their body as well as their
+	// method, path and query
+	MatchBody bool `mapstructure:"match-body"`
+
+	// What to do with unmatched requests, either ReplayFail
+	// (respond with a 502) or ReplayPass (send them upstream).
+	// Defaults to ReplayFail.
+	Unmatched string `mapstructure:"unmatched"`
+}
+
+// replayTransport serves recorded responses. Requests recorded more
+// than once are served each recorded response in turn.
+type replayTransport struct {
+	matchBody bool
+	next      http.RoundTripper
+
+	mu      sync.Mutex
+	entries map[string][]*harEntry
+	served  map[string]int
+}
+
+// makeReplayTransport creates a transport replaying cfg's recording.
+// Unmatched requests are sent with next, if cfg allows it.
+func makeReplayTransport(cfg *ReplayConfig, next http.RoundTripper) (http.RoundTripper, error) {
+	switch cfg.Unmatched {
+	case "", ReplayFail:
+		next = nil
+	case ReplayPass:
+	default:
+		return nil, fmt.Errorf("unknown replay unmatched option %q", cfg.Unmatched)
+	}
+	entries, err := readRecording(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+	t := &replayTransport{
+		matchBody: cfg.MatchBody,
+		next:      next,
+		entries:   map[string][]*harEntry{},
+		served:    map[string]int{},
+	}
+	for _, e := range entries {
+		// Requests that failed while recording (e.g. dropped ones)
+		// have no response to replay, so they're left unmatched...
+		if e.Response.Status == 0 {
+			continue
+		}
+		u, err := url.Parse(e.Request.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recorded url %q: %w", e.Request.URL, err)
+		}
+		var body []byte
+		if pd := e.Request.PostData; pd != nil {
+			if body, err = decodeHARText(pd.Text, pd.Encoding); err != nil {
+				return nil, err
+			}
+		}
+		k := t.key(e.Request.Method, u, body)
+		t.entries[k] = append(t.entries[k], e)
+	}
+	return t, nil
+}
+
+func (t *replayTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// Read the body, if it's matched on...
+	var body []byte
+	if t.matchBody && r.Body != nil {
+		b, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		body = b
+		r.Body = io.NopCloser(bytes.NewReader(b))
+	}
+
+	// Find the next recorded response...
+	k := t.key(r.Method, r.URL, body)
+	t.mu.Lock()
+	es := t.entries[k]
+	var e *harEntry
+	if len(es) > 0 {
+		e = es[t.served[k]%len(es)]
+		t.served[k]++
+	}
+	t.mu.Unlock()
+
+	if e == nil {
+		if t.next != nil {
+			return t.next.RoundTrip(r)
+		}
+		msg := fmt.Sprintf("red-tape: no recorded response for %s %s", r.Method, r.URL.RequestURI())
+		return makeResponse(r, http.StatusBadGateway, msg), nil
+	}
+	return e.response(r)
+}
+
+// key returns the key a request is matched on.
+func (t *replayTransport) key(method string, u *url.URL, body []byte) string {
+	k := method + " " + u.EscapedPath() + "?" + u.Query().Encode()
+	if t.matchBody {
+		h := sha256.Sum256(body)
+		k += " " + hex.EncodeToString(h[:])
+	}
+	return k
+}
+
+// response creates a response to r from a recorded entry.
+func (e *harEntry) response(r *http.Request) (*http.Response, error) {
+	body, err := decodeHARText(e.Response.Content.Text, e.Response.Content.Encoding)
+	if err != nil {
+		return nil, err
+	}
+	res := &http.Response{
+		Status:        strconv.Itoa(e.Response.Status) + " " + http.StatusText(e.Response.Status),
+		StatusCode:    e.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       r,
+	}
+	for _, h := range e.Response.Headers {
+		switch http.CanonicalHeaderKey(h.Name) {
+		case "Content-Length", "Transfer-Encoding":
+			continue
+		}
+		res.Header.Add(h.Name, h.Value)
+	}
+	return res, nil
+}
+
+// decodeHARText decodes a HAR body's text.
+func decodeHARText(text, encoding string) ([]byte, error) {
+	if encoding == "base64" {
+		return base64.StdEncoding.DecodeString(text)
+	}
+	return []byte(text), nil
+}
+
+// readRecording reads the entries from a HAR or JSONL recording.
+func readRecording(path string) ([]*harEntry, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// A HAR file is a single object with a "log"...
+	var har struct {
+		Log *struct {
+			Entries []*harEntry `json:"entries"`
+		} `json:"log"`
+	}
+	if err := json.Unmarshal(b, &har); err == nil && har.Log != nil {
+		return har.Log.Entries, nil
+	}
+
+	// ...otherwise it's an entry per line...
+	var entries []*harEntry
+	s := bufio.NewScanner(bytes.NewReader(b))
+	s.Buffer(nil, len(b)+1)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		var e harEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid entry: %w", path, n, err)
+		}
+		entries = append(entries, &e)
+	}
+	return entries, s.Err()
+}
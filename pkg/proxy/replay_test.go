@@ -0,0 +1,120 @@
+package proxy_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/a-poor/red-tape/pkg/proxy"
+)
+
+func TestReplay(t *testing.T) {
+	// Record some traffic...
+	n := 0
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		w.Header().Set("X-Count", fmt.Sprint(n))
+		fmt.Fprintf(w, "%s %d", r.URL.Path, n)
+	}))
+	path := filepath.Join(t.TempDir(), "out.jsonl")
+	rec, err := proxy.MakeRecorder(&proxy.RecordConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt, err := proxy.MakeRoundTripper(&proxy.ProxyConfig{DestURL: up.URL, Recorder: rec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(rt http.RoundTripper, u string) (int, string) {
+		req, _ := http.NewRequest(http.MethodGet, u, nil)
+		res, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		return res.StatusCode, string(b)
+	}
+	get(rt, up.URL+"/a?x=1")
+	get(rt, up.URL+"/a?x=1")
+	rec.Close()
+	up.Close()
+
+	// ...and replay it, with the upstream gone...
+	rt, err = proxy.MakeRoundTripper(&proxy.ProxyConfig{
+		DestURL: up.URL,
+		Replay:  proxy.ReplayConfig{Path: path},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"/a 1", "/a 2", "/a 1"} {
+		if status, body := get(rt, up.URL+"/a?x=1"); status != http.StatusOK || body != want {
+			t.Errorf("expected 200 %q, got %d %q", want, status, body)
+		}
+	}
+	if status, _ := get(rt, up.URL+"/a?x=2"); status != http.StatusBadGateway {
+		t.Errorf("expected unmatched requests to fail with 502, got %d", status)
+	}
+
+	// ...with faults on top...
+	rt, err = proxy.MakeRoundTripper(&proxy.ProxyConfig{
+		DestURL: up.URL,
+		Faults:  proxy.Faults{ProbError: 1},
+		Replay:  proxy.ReplayConfig{Path: path},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := get(rt, up.URL+"/a?x=1"); status != http.StatusServiceUnavailable {
+		t.Errorf("expected an injected 503, got %d", status)
+	}
+}
+
+func TestReplayFailedEntry(t *testing.T) {
+	// Record a request failing with a network error...
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	path := filepath.Join(t.TempDir(), "out.har")
+	rec, err := proxy.MakeRecorder(&proxy.RecordConfig{Path: path, Format: proxy.RecordHAR})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := proxy.MakeProxy(&proxy.ProxyConfig{
+		DestURL:  up.URL,
+		Faults:   proxy.Faults{ProbNetError: 1},
+		Recorder: rec,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(p)
+	if res, err := http.Get(srv.URL + "/a"); err == nil {
+		res.Body.Close()
+	}
+	srv.Close()
+	rec.Close()
+
+	// ...and replay it: it's treated as unmatched, rather than
+	// served with a status of 0.
+	p, err = proxy.MakeProxy(&proxy.ProxyConfig{
+		DestURL: up.URL,
+		Replay:  proxy.ReplayConfig{Path: path},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv = httptest.NewServer(p)
+	defer srv.Close()
+	res, err := http.Get(srv.URL + "/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected the failed request to be unmatched (502), got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The names of the faults recorded in a RequestLog.
+const (
+	FaultPreDelay       = "pre-delay"
+	FaultPostDelay      = "post-delay"
+	FaultLoadDelay      = "load-delay"
+	FaultDrop           = "drop"
+	FaultError          = "error"
+	FaultNetError       = "net-error"
+	FaultState          = "state"
+	FaultQueue          = "queue"
+	FaultQueueFull      = "queue-full"
+	FaultQueueTimeout   = "queue-timeout"
+	FaultEventDelay     = "event-delay"
+	FaultDropEvent      = "drop-event"
+	FaultStreamCut      = "stream-cut"
+	FaultHeartbeatStall = "heartbeat-stall"
+	FaultHeader         = "header"
+	FaultJSON           = "json"
+	FaultRedirect       = "redirect"
+	FaultRedirectDelay  = "redirect-delay"
+)
+
+// The names of the timed phases recorded in a RequestLog.
+const (
+	PhasePreDelay      = "pre-delay"
+	PhaseLoadDelay     = "load-delay"
+	PhaseQueue         = "queue"
+	PhaseUpstream      = "upstream"
+	PhasePostDelay     = "post-delay"
+	PhaseThrottle      = "throttle"
+	PhaseRedirectDelay = "redirect-delay"
+)
+
+// Decision records a fault red-tape injected into a request.
+type Decision struct {
+	// When the decision was made
+	At time.Time `json:"at"`
+
+	// The name of the fault (e.g. FaultPreDelay)
+	Fault string `json:"fault"`
+
+	// The delay that was added, for delay faults
+	Delay time.Duration `json:"delay,omitempty"`
+
+	// Any other value sampled for the fault
+	Value string `json:"value,omitempty"`
+}
+
+// Phase is a timed part of handling a request, like the pre-delay
+// or the upstream round trip.
+type Phase struct {
+	Name       string
+	Start, End time.Time
+}
+
+// RequestLog records what happened to a request as it passed
+// through red-tape. It's completed once the response body is closed
+// (or the request fails) and then passed to the proxy's observers.
+type RequestLog struct {
+	// When red-tape received the request
+	Start time.Time
+
+	// The request's method and URL (as sent upstream)
+	Method string
+	URL    string
+
+	// The client's address
+	ClientAddr string
+
+	// The upstream host
+	Upstream string
+
+	// The name of the rule that matched (empty for the defaults)
+	Rule string
+
+	// The response status code (0 if there was no response)
+	Status int
+
+	// The error returned instead of a response, if any
+	Err error
+
+	// The number of request and response body bytes
+	BytesIn  int64
+	BytesOut int64
+
+	// How long the upstream took to return the response headers
+	UpstreamLatency time.Duration
+
+	// The total time, from receiving the request until the response
+	// body was closed
+	Duration time.Duration
+
+	// The W3C trace context of red-tape's span for the request, if
+	// tracing is enabled. ParentSpanID is from the incoming
+	// traceparent header, if there was one.
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+
+	// The span ID propagated to the upstream
+	upstreamSpanID string
+
+	mu        sync.Mutex
+	decisions []Decision
+	phases    []Phase
+}
+
+// Phases returns the timed phases of the request.
+func (l *RequestLog) Phases() []Phase {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Phase(nil), l.phases...)
+}
+
+// phase records a timed phase of the request.
+func (l *RequestLog) phase(name string, start, end time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.phases = append(l.phases, Phase{Name: name, Start: start, End: end})
+}
+
+// sleep sleeps for d, recording it as a phase if d > 0.
+func (l *RequestLog) sleep(name string, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	start := time.Now()
+	time.Sleep(d)
+	l.phase(name, start, time.Now())
+}
+
+// Decisions returns the faults injected into the request.
+func (l *RequestLog) Decisions() []Decision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Decision(nil), l.decisions...)
+}
+
+// AddedDelay returns the total delay injected into the request.
+func (l *RequestLog) AddedDelay() time.Duration {
+	var d time.Duration
+	for _, dec := range l.Decisions() {
+		d += dec.Delay
+	}
+	return d
+}
+
+// decide records a fault decision. It's safe to call on a nil log.
+func (l *RequestLog) decide(d Decision) {
+	if l == nil {
+		return
+	}
+	if d.At.IsZero() {
+		d.At = time.Now()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.decisions = append(l.decisions, d)
+}
+
+// delay records a delay fault, if any delay was added.
+func (l *RequestLog) delay(fault string, d time.Duration) {
+	if d > 0 {
+		l.decide(Decision{Fault: fault, Delay: d})
+	}
+}
+
+// Observer is passed each RequestLog once it's complete.
+type Observer interface {
+	Observe(l *RequestLog)
+}
+
+type requestLogKey struct{}
+
+// RequestLogFromContext returns the RequestLog for the request being
+// handled with ctx, or nil if there isn't one.
+func RequestLogFromContext(ctx context.Context) *RequestLog {
+	l, _ := ctx.Value(requestLogKey{}).(*RequestLog)
+	return l
+}
+
+// startRequestLog creates a RequestLog for r and returns a copy of r
+// carrying it in its context.
+func startRequestLog(r *http.Request, rule string) (*RequestLog, *http.Request) {
+	l := &RequestLog{
+		Start:      time.Now(),
+		Method:     r.Method,
+		URL:        r.URL.String(),
+		ClientAddr: r.RemoteAddr,
+		Upstream:   r.URL.Host,
+		Rule:       rule,
+	}
+	return l, r.WithContext(context.WithValue(r.Context(), requestLogKey{}, l))
+}
+
+// countingBody counts the bytes read from a body and calls onClose
+// once, when it's closed.
+type countingBody struct {
+	io.ReadCloser
+	n       *int64
+	once    sync.Once
+	onClose func()
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(b.n, int64(n))
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.onClose != nil {
+		b.once.Do(b.onClose)
+	}
+	return err
+}
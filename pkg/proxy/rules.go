@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Rule overrides the default fault settings for requests to a
+// matching destination.
+type Rule struct {
+	// A name for the rule, used when logging
+	Name string `mapstructure:"name"`
+
+	// The destination host to match. A leading "*." matches any
+	// subdomain and an empty host matches any host.
+	Host string `mapstructure:"host"`
+
+	// The destination port to match (empty matches any port)
+	Port string `mapstructure:"port"`
+
+	// An expression that must also be true for the rule to match,
+	// e.g. header("X-User") == "x" && counter("x") % 3 == 0. Rules
+	// with a condition only match HTTP requests, not tunnels.
+	When string `mapstructure:"when"`
+
+	// Expressions for fault parameters, replacing the rule's values
+	// for each request, e.g. {"pre-delay-max": "elapsed * 10"}. See
+	// ParamNames for the parameters.
+	Params map[string]string `mapstructure:"params"`
+
+	// The faults to inject for matching requests
+	Faults `mapstructure:",squash"`
+
+	when   *expr
+	params map[string]*expr
+}
+
+// paramSetters set the fault parameters that can be expressions.
+// Probabilities are clamped to [0, 1] and delays to at least 0, and
+// error statuses that aren't valid are ignored.
+var paramSetters = map[string]func(f *Faults, v float64){
+	"prob-drop":       func(f *Faults, v float64) { f.ProbDrop = clampProb(v) },
+	"pre-delay-rate":  func(f *Faults, v float64) { f.PreDelayRate = math.Max(v, 0) },
+	"pre-delay-max":   func(f *Faults, v float64) { f.PreDelayMax = math.Max(v, 0) },
+	"post-delay-rate": func(f *Faults, v float64) { f.PostDelayRate = math.Max(v, 0) },
+	"post-delay-max":  func(f *Faults, v float64) { f.PostDelayMax = math.Max(v, 0) },
+	"prob-error":      func(f *Faults, v float64) { f.ProbError = clampProb(v) },
+	"error-status": func(f *Faults, v float64) {
+		// (Checked before converting, since huge floats don't
+		// convert to ints portably.)
+		if v >= 100 && v < 600 {
+			f.ErrorStatus = int(v)
+		}
+	},
+	"prob-net-error": func(f *Faults, v float64) { f.ProbNetError = clampProb(v) },
+}
+
+func clampProb(p float64) float64 {
+	return math.Min(math.Max(p, 0), 1)
+}
+
+// ParamNames returns the names of the fault parameters that can be
+// set with expressions.
+func ParamNames() []string {
+	var names []string
+	for k := range paramSetters {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// compile compiles the rule's condition and parameter expressions.
+func (r *Rule) compile() error {
+	r.when = nil
+	if r.When != "" {
+		e, err := compileExpr(r.When, exprBool)
+		if err != nil {
+			return err
+		}
+		r.when = e
+	}
+	r.params = map[string]*expr{}
+	for k, src := range r.Params {
+		if _, ok := paramSetters[k]; !ok {
+			return fmt.Errorf("unknown parameter %q", k)
+		}
+		e, err := compileExpr(src, exprNumber)
+		if err != nil {
+			return fmt.Errorf("parameter %q: %w", k, err)
+		}
+		r.params[k] = e
+	}
+	return nil
+}
+
+// readsBody returns true if the rule's expressions read the request
+// body.
+func (r *Rule) readsBody() bool {
+	if r.when != nil && r.when.body {
+		return true
+	}
+	for _, e := range r.params {
+		if e.body {
+			return true
+		}
+	}
+	return false
+}
+
+// faults returns the rule's faults, with the parameters set from its
+// expressions. Parameters that evaluate to NaN or an infinity keep
+// the rule's value.
+func (r *Rule) faults(env *exprEnv) *Faults {
+	if len(r.params) == 0 || env == nil {
+		return &r.Faults
+	}
+	f := r.Faults
+	for k, e := range r.params {
+		v := e.evalNumber(env)
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		paramSetters[k](&f, v)
+	}
+	return &f
+}
+
+// Matches returns true if the rule applies to the destination.
+func (r *Rule) Matches(host, port string) bool {
+	if r.Port != "" && r.Port != port {
+		return false
+	}
+	switch {
+	case r.Host == "":
+		return true
+	case strings.HasPrefix(r.Host, "*."):
+		return strings.HasSuffix(strings.ToLower(host), strings.ToLower(r.Host[1:]))
+	default:
+		return strings.EqualFold(r.Host, host)
+	}
+}
+
+// match returns the name of the first rule matching the destination
+// and its faults. If no rule matches, the live faults are returned
+// with their name, if they're set, and otherwise the default faults
+// are returned with an empty name.
+func (cfg *ProxyConfig) match(host, port string) (string, *Faults) {
+	return cfg.matchEnv(host, port, nil)
+}
+
+// matchRequest is like match, for a request, evaluating the rules'
+// expressions in env.
+func (cfg *ProxyConfig) matchRequest(r *http.Request, env *exprEnv) (string, *Faults) {
+	host, port := splitHostPort(r.URL)
+	return cfg.matchEnv(host, port, env)
+}
+
+func (cfg *ProxyConfig) matchEnv(host, port string, env *exprEnv) (string, *Faults) {
+	for i := range cfg.Rules {
+		r := &cfg.Rules[i]
+		if !r.Matches(host, port) {
+			continue
+		}
+		if r.When != "" && (env == nil || r.when == nil || !r.when.evalBool(env)) {
+			continue
+		}
+		return r.Name, r.faults(env)
+	}
+	if name, f := cfg.Live.Get(); f != nil {
+		return name, f
+	}
+	return "", &cfg.Faults
+}
+
+// splitHostPort splits a URL's host and port, filling in the port
+// from its scheme if it isn't explicit.
+func splitHostPort(u *url.URL) (string, string) {
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "https", "wss":
+			port = "443"
+		case "http", "ws":
+			port = "80"
+		}
+	}
+	return u.Hostname(), port
+}
+
+// splitAddr splits a "host:port" address, like the target of a
+// CONNECT request.
+func splitAddr(addr string) (string, string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, ""
+	}
+	return host, port
+}
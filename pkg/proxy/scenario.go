@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// LiveFaults holds faults that can be swapped while the proxy is
+// running. When set, they replace the default faults (rules still
+// take precedence). It's safe for concurrent use.
+type LiveFaults struct {
+	p atomic.Pointer[liveFaults]
+}
+
+type liveFaults struct {
+	name string
+	f    *Faults
+}
+
+// Set replaces the live faults. The name is recorded as the rule for
+// requests using them. A nil f restores the default faults.
+func (l *LiveFaults) Set(name string, f *Faults) {
+	if f == nil {
+		l.p.Store(nil)
+		return
+	}
+	l.p.Store(&liveFaults{name: name, f: f})
+}
+
+// Get returns the live faults and their name, or nil if they aren't
+// set. It's safe to call on nil LiveFaults.
+func (l *LiveFaults) Get() (string, *Faults) {
+	if l == nil {
+		return "", nil
+	}
+	lf := l.p.Load()
+	if lf == nil {
+		return "", nil
+	}
+	return lf.name, lf.f
+}
+
+// Scenario is a timeline of faults, like an incident to rehearse.
+// Each phase's faults are applied in turn, for the phase's duration.
+type Scenario struct {
+	// The phases, in order
+	Phases []ScenarioPhase `mapstructure:"phases"`
+
+	// Start again from the first phase after the last one (otherwise
+	// the default faults are restored)
+	Loop bool `mapstructure:"loop"`
+
+	// How often ramping faults are updated (defaults to 1s)
+	Step time.Duration `mapstructure:"step"`
+
+	// The clock the scenario runs on (defaults to the system clock)
+	Clock Clock `mapstructure:"-"`
+}
+
+// Clock tells the time for a Scenario, so tests can step through one
+// without waiting.
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+
+	// After returns a channel that receives the time once d has
+	// passed
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the Clock for the real time.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// ScenarioPhase is a single phase of a Scenario.
+type ScenarioPhase struct {
+	// A name for the phase, recorded as the rule for its requests
+	Name string `mapstructure:"name"`
+
+	// How long the phase lasts
+	Duration time.Duration `mapstructure:"duration"`
+
+	// The faults to inject (no faults if empty)
+	Faults Faults `mapstructure:"faults"`
+
+	// If set, the faults ramp from Faults at the start of the phase
+	// to RampTo at its end. Probabilities and maximum delays are
+	// interpolated linearly, and delay rates are interpolated so
+	// their mean delay changes linearly. Stream faults aren't ramped.
+	RampTo *Faults `mapstructure:"ramp-to"`
+}
+
+// Validate checks the scenario can be run.
+func (s *Scenario) Validate() error {
+	if len(s.Phases) == 0 {
+		return fmt.Errorf("scenario has no phases")
+	}
+	for i, p := range s.Phases {
+		if p.Duration <= 0 {
+			return fmt.Errorf("scenario phase %d (%q) needs a positive duration", i, p.Name)
+		}
+		if err := p.Faults.validate(); err != nil {
+			return fmt.Errorf("scenario phase %d (%q): %w", i, p.Name, err)
+		}
+		if p.RampTo != nil {
+			if err := p.RampTo.validate(); err != nil {
+				return fmt.Errorf("scenario phase %d (%q) ramp: %w", i, p.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Run applies the scenario's phases to live until it's finished or
+// ctx is done. Either way, the default faults are restored before
+// it returns.
+func (s *Scenario) Run(ctx context.Context, live *LiveFaults, logger log.Logger) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	if logger == nil {
+		logger = log.Default()
+	}
+	defer live.Set("", nil)
+	step := s.Step
+	if step <= 0 {
+		step = time.Second
+	}
+	clock := s.Clock
+	if clock == nil {
+		clock = systemClock{}
+	}
+
+	for {
+		for i := range s.Phases {
+			p := &s.Phases[i]
+			logger.Info("Starting scenario phase.", "phase", p.Name, "duration", p.Duration)
+			start := clock.Now()
+
+			// Apply the phase's faults, updating ramps every step...
+			live.Set(p.Name, p.at(0))
+			for {
+				elapsed := clock.Now().Sub(start)
+				if elapsed >= p.Duration {
+					break
+				}
+				if p.RampTo != nil && elapsed > 0 {
+					live.Set(p.Name, p.at(float64(elapsed)/float64(p.Duration)))
+				}
+				wait := step
+				if left := p.Duration - elapsed; left < wait {
+					wait = left
+				}
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-clock.After(wait):
+				}
+			}
+		}
+		if !s.Loop {
+			logger.Info("Scenario finished.")
+			return nil
+		}
+	}
+}
+
+// at returns the phase's faults at fraction t of the way through it.
+func (p *ScenarioPhase) at(t float64) *Faults {
+	f := p.Faults
+	if p.RampTo == nil {
+		return &f
+	}
+	if t > 1 {
+		t = 1
+	}
+	to := p.RampTo
+	f.ProbDrop = lerp(f.ProbDrop, to.ProbDrop, t)
+	f.PreDelayRate = lerpRate(f.PreDelayRate, to.PreDelayRate, t)
+	f.PreDelayMax = lerp(f.PreDelayMax, to.PreDelayMax, t)
+	f.PostDelayRate = lerpRate(f.PostDelayRate, to.PostDelayRate, t)
+	f.PostDelayMax = lerp(f.PostDelayMax, to.PostDelayMax, t)
+	f.ProbError = lerp(f.ProbError, to.ProbError, t)
+	f.ProbNetError = lerp(f.ProbNetError, to.ProbNetError, t)
+	if f.ErrorStatus == 0 {
+		f.ErrorStatus = to.ErrorStatus
+	}
+	return &f
+}
+
+// lerp interpolates linearly from a to b.
+func lerp(a, b, t float64) float64 {
+	return a + (b-a)*t
+}
+
+// lerpRate interpolates between two exponential rates, so the mean
+// (1/rate) changes linearly. A rate of 0 (no delay) has a mean of 0.
+func lerpRate(a, b, t float64) float64 {
+	mean := func(r float64) float64 {
+		if r <= 0 {
+			return 0
+		}
+		return 1 / r
+	}
+	m := lerp(mean(a), mean(b), t)
+	if m <= 0 {
+		return 0
+	}
+	return 1 / m
+}
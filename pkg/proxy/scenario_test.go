@@ -0,0 +1,171 @@
+package proxy_test
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/a-poor/red-tape/pkg/proxy"
+)
+
+func TestScenarioPhases(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+
+	live := &proxy.LiveFaults{}
+	rt, err := proxy.MakeRoundTripper(&proxy.ProxyConfig{DestURL: up.URL, Live: live})
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := func() int {
+		req, _ := http.NewRequest(http.MethodGet, up.URL, nil)
+		res, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	clock := newFakeClock()
+	s := &proxy.Scenario{
+		Phases: []proxy.ScenarioPhase{
+			{Name: "clean", Duration: 50 * time.Millisecond},
+			{Name: "outage", Duration: 100 * time.Millisecond, Faults: proxy.Faults{ProbError: 1}},
+		},
+		Step:  10 * time.Millisecond,
+		Clock: clock,
+	}
+	done := make(chan error)
+	go func() { done <- s.Run(context.Background(), live, nil) }()
+	clock.wait()
+
+	clock.step(25 * time.Millisecond)
+	if got := status(); got != http.StatusOK {
+		t.Errorf("expected status 200 while clean, got %d", got)
+	}
+	clock.step(30 * time.Millisecond)
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503 during the outage, got %d", got)
+	}
+	clock.advance(100 * time.Millisecond)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := status(); got != http.StatusOK {
+		t.Errorf("expected status 200 after the scenario, got %d", got)
+	}
+}
+
+func TestScenarioRamp(t *testing.T) {
+	live := &proxy.LiveFaults{}
+	clock := newFakeClock()
+	s := &proxy.Scenario{
+		Phases: []proxy.ScenarioPhase{{
+			Name:     "ramp",
+			Duration: 200 * time.Millisecond,
+			Faults:   proxy.Faults{PreDelayRate: 0.01},
+			RampTo:   &proxy.Faults{PreDelayRate: 0.0005},
+		}},
+		Step:  10 * time.Millisecond,
+		Clock: clock,
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx, live, nil)
+	clock.wait()
+
+	clock.step(100 * time.Millisecond)
+	name, f := live.Get()
+	if name != "ramp" || f == nil {
+		t.Fatalf("expected the ramp phase's faults, got %q", name)
+	}
+
+	// Halfway through, the mean delay should be halfway between
+	// 100ms and 2s...
+	if mean := 1 / f.PreDelayRate; math.Abs(mean-1050) > 1e-6 {
+		t.Errorf("expected a mean delay of 1050ms, got %.0fms", mean)
+	}
+}
+
+func TestScenarioValidate(t *testing.T) {
+	// A phase's ramp is checked like its faults.
+	s := &proxy.Scenario{
+		Phases: []proxy.ScenarioPhase{{
+			Name:     "ramp",
+			Duration: time.Second,
+			RampTo:   &proxy.Faults{ErrorStatus: 1000},
+		}},
+	}
+	if err := s.Validate(); err == nil {
+		t.Error("expected an error for an invalid ramp")
+	}
+	s.Phases[0].RampTo.ErrorStatus = http.StatusServiceUnavailable
+	if err := s.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// fakeClock is a proxy.Clock that only moves when it's advanced.
+type fakeClock struct {
+	mu     sync.Mutex
+	t      time.Time
+	timers []fakeTimer
+	waits  chan struct{} // Signalled each time After is called
+}
+
+type fakeTimer struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Unix(0, 0), waits: make(chan struct{}, 64)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	ch := make(chan time.Time, 1)
+	c.timers = append(c.timers, fakeTimer{c.t.Add(d), ch})
+	c.mu.Unlock()
+	c.waits <- struct{}{}
+	return ch
+}
+
+// wait blocks until the scenario is waiting on the clock.
+func (c *fakeClock) wait() {
+	<-c.waits
+}
+
+// advance moves the clock on by d, firing the timers that are due.
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+	timers := c.timers[:0]
+	for _, tm := range c.timers {
+		if tm.at.After(c.t) {
+			timers = append(timers, tm)
+			continue
+		}
+		tm.c <- c.t
+	}
+	c.timers = timers
+}
+
+// step advances the clock by d and waits for the scenario to catch
+// up.
+func (c *fakeClock) step(d time.Duration) {
+	c.advance(d)
+	c.wait()
+}
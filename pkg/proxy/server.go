@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// The default permissions for Unix socket files.
+const DefaultSocketMode os.FileMode = 0o660
+
+// ListenConfig configures the listener red-tape serves on.
+type ListenConfig struct {
+	// The address to listen on, either "host:port" or the path of a
+	// Unix socket, as "unix:///path/to/red-tape.sock"
+	Addr string
+
+	// The permissions for a Unix socket file (defaults to
+	// DefaultSocketMode)
+	SocketMode os.FileMode
+
+	// If set, TLS is terminated for incoming connections
+	TLS *tls.Config
+}
+
+// Listen creates the listener red-tape serves on.
+func Listen(cfg *ListenConfig) (net.Listener, error) {
+	var l net.Listener
+	var err error
+	if path, ok := unixSocketPath(cfg.Addr); ok {
+		mode := cfg.SocketMode
+		if mode == 0 {
+			mode = DefaultSocketMode
+		}
+		l, err = listenUnix(path, mode)
+	} else {
+		l, err = net.Listen("tcp", cfg.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cfg.TLS != nil {
+		l = tls.NewListener(l, cfg.TLS)
+	}
+	return l, nil
+}
+
+// listenUnix listens on a Unix socket, removing a stale socket file
+// left behind by a previous process. The socket file is removed
+// when the listener is closed.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	// Check for an existing socket...
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%q already exists and isn't a socket", path)
+		}
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("socket %q is already in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("removing stale socket: %w", err)
+		}
+	}
+
+	// Listen and set the permissions...
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// unixSocketPath returns the socket path from a "unix://" address.
+func unixSocketPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, "unix://") {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, "unix://"), true
+}
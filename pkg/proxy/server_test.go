@@ -0,0 +1,69 @@
+package proxy_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/a-poor/red-tape/pkg/proxy"
+)
+
+func TestUnixSockets(t *testing.T) {
+	dir := t.TempDir()
+	upPath := filepath.Join(dir, "upstream.sock")
+	rtPath := filepath.Join(dir, "red-tape.sock")
+
+	// Serve the upstream on a Unix socket...
+	upL, err := proxy.Listen(&proxy.ListenConfig{Addr: "unix://" + upPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})}
+	go up.Serve(upL)
+	defer up.Close()
+
+	// Leave a stale socket file behind for red-tape's listener...
+	stale, err := net.Listen("unix", rtPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	// Proxy from one socket to the other...
+	p, err := proxy.MakeProxy(&proxy.ProxyConfig{DestURL: "unix://" + upPath})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := proxy.Listen(&proxy.ListenConfig{Addr: "unix://" + rtPath, SocketMode: 0o600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: p}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	if fi, err := os.Stat(rtPath); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Fatalf("expected socket with mode 0600, got %v (%v)", fi.Mode(), err)
+	}
+
+	c := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", rtPath)
+		},
+	}}
+	res, err := c.Get("http://red-tape/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", res.StatusCode)
+	}
+}
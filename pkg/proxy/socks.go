@@ -0,0 +1,288 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/charmbracelet/log"
+)
+
+// SOCKS5 protocol constants (RFC 1928 and RFC 1929).
+const (
+	socksVersion     = 0x05
+	socksAuthVersion = 0x01
+
+	socksMethodNone     = 0x00
+	socksMethodPassword = 0x02
+	socksMethodRefused  = 0xff
+
+	socksCmdConnect = 0x01
+
+	socksAddrIPv4   = 0x01
+	socksAddrDomain = 0x03
+	socksAddrIPv6   = 0x04
+
+	socksReplySucceeded       = 0x00
+	socksReplyFailure         = 0x01
+	socksReplyRefused         = 0x05
+	socksReplyCmdUnsupported  = 0x07
+	socksReplyAddrUnsupported = 0x08
+)
+
+// SOCKS5Config configures red-tape's SOCKS5 listener.
+type SOCKS5Config struct {
+	// Credentials for username/password authentication. If Username
+	// is empty, clients don't need to authenticate.
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+}
+
+// SOCKS5Server is a SOCKS5 proxy that dials destinations with the
+// same faults (and rules) as the HTTP proxies. Only the CONNECT
+// command is supported.
+type SOCKS5Server struct {
+	cfg    *SOCKS5Config
+	dialer *Dialer
+	logger log.Logger
+}
+
+// MakeSOCKS5Server creates a SOCKS5Server that uses cfg's fault
+// settings and rules, matched on destination host and port.
+func MakeSOCKS5Server(cfg *ProxyConfig, socks *SOCKS5Config) (*SOCKS5Server, error) {
+	if socks == nil {
+		socks = &SOCKS5Config{}
+	}
+	return &SOCKS5Server{
+		cfg:    socks,
+		dialer: MakeDialer(cfg),
+		logger: cfg.logger(),
+	}, nil
+}
+
+// Serve accepts connections from l, until l is closed.
+func (s *SOCKS5Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		go s.ServeConn(c)
+	}
+}
+
+// ServeConn handles a single SOCKS5 client connection.
+func (s *SOCKS5Server) ServeConn(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+
+	// Negotiate authentication...
+	if err := s.handshake(r, c); err != nil {
+		s.logger.Debug("SOCKS5 handshake failed.", "client", c.RemoteAddr(), "err", err)
+		return
+	}
+
+	// Read the request...
+	addr, err := readSOCKSRequest(r)
+	var re *socksReplyError
+	if errors.As(err, &re) {
+		writeSOCKSReply(c, re.code, nil)
+		return
+	}
+	if err != nil {
+		s.logger.Debug("Failed to read SOCKS5 request.", "client", c.RemoteAddr(), "err", err)
+		return
+	}
+
+	// Connect to the destination...
+	dst, err := s.dialer.DialContext(context.Background(), "tcp", addr)
+	if errors.Is(err, ErrDropped) {
+		return
+	}
+	if err != nil {
+		s.logger.Debug("Failed to dial SOCKS5 destination.", "addr", addr, "err", err)
+		code := byte(socksReplyFailure)
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			code = socksReplyRefused
+		}
+		writeSOCKSReply(c, code, nil)
+		return
+	}
+	defer dst.Close()
+	if err := writeSOCKSReply(c, socksReplySucceeded, dst.LocalAddr()); err != nil {
+		return
+	}
+
+	// Copy in both directions until either side is done...
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(dst, r)
+		closeWrite(dst)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(c, dst)
+		closeWrite(c)
+	}()
+	wg.Wait()
+}
+
+// handshake negotiates the authentication method with the client
+// and, if needed, checks its credentials.
+func (s *SOCKS5Server) handshake(r *bufio.Reader, w io.Writer) error {
+	// Read the offered methods...
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != socksVersion {
+		return fmt.Errorf("unsupported socks version %d", hdr[0])
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return err
+	}
+
+	// Pick one...
+	want := byte(socksMethodNone)
+	if s.cfg.Username != "" {
+		want = socksMethodPassword
+	}
+	offered := false
+	for _, m := range methods {
+		offered = offered || m == want
+	}
+	if !offered {
+		w.Write([]byte{socksVersion, socksMethodRefused})
+		return errors.New("no acceptable auth method")
+	}
+	if _, err := w.Write([]byte{socksVersion, want}); err != nil {
+		return err
+	}
+	if want == socksMethodNone {
+		return nil
+	}
+
+	// Check the username and password...
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
+	}
+	if hdr[0] != socksAuthVersion {
+		return fmt.Errorf("unsupported auth version %d", hdr[0])
+	}
+	user := make([]byte, hdr[1])
+	if _, err := io.ReadFull(r, user); err != nil {
+		return err
+	}
+	n, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	pass := make([]byte, n)
+	if _, err := io.ReadFull(r, pass); err != nil {
+		return err
+	}
+	userOK := subtle.ConstantTimeCompare(user, []byte(s.cfg.Username))
+	passOK := subtle.ConstantTimeCompare(pass, []byte(s.cfg.Password))
+	if userOK&passOK != 1 {
+		w.Write([]byte{socksAuthVersion, 0x01})
+		return errors.New("invalid credentials")
+	}
+	_, err = w.Write([]byte{socksAuthVersion, 0x00})
+	return err
+}
+
+// socksReplyError is an error that should be reported to the client
+// with a reply code.
+type socksReplyError struct {
+	code byte
+}
+
+func (e *socksReplyError) Error() string {
+	return fmt.Sprintf("socks error %d", e.code)
+}
+
+// readSOCKSRequest reads a CONNECT request, returning the destination
+// address.
+func readSOCKSRequest(r *bufio.Reader) (string, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return "", err
+	}
+	if hdr[0] != socksVersion {
+		return "", fmt.Errorf("unsupported socks version %d", hdr[0])
+	}
+	if hdr[1] != socksCmdConnect {
+		return "", &socksReplyError{socksReplyCmdUnsupported}
+	}
+
+	// Read the host...
+	var host string
+	switch hdr[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if hdr[3] == socksAddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		n, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		host = string(b)
+	default:
+		return "", &socksReplyError{socksReplyAddrUnsupported}
+	}
+
+	// ...and the port...
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	p := strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))
+	return net.JoinHostPort(host, p), nil
+}
+
+// writeSOCKSReply writes a reply to a request, with the address
+// bound for the connection (if any).
+func writeSOCKSReply(w io.Writer, code byte, bound net.Addr) error {
+	ip := net.IPv4zero.To4()
+	port := 0
+	if a, ok := bound.(*net.TCPAddr); ok {
+		port = a.Port
+		if a.IP.To4() != nil {
+			ip = a.IP.To4()
+		} else {
+			ip = a.IP.To16()
+		}
+	}
+	typ := byte(socksAddrIPv4)
+	if len(ip) == net.IPv6len {
+		typ = socksAddrIPv6
+	}
+	b := append([]byte{socksVersion, code, 0x00, typ}, ip...)
+	b = binary.BigEndian.AppendUint16(b, uint16(port))
+	_, err := w.Write(b)
+	return err
+}
@@ -0,0 +1,167 @@
+package proxy_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/a-poor/red-tape/pkg/proxy"
+)
+
+func TestSOCKS5Connect(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer up.Close()
+
+	addr := serveSOCKS5(t, &proxy.ProxyConfig{}, &proxy.SOCKS5Config{
+		Username: "user",
+		Password: "pass",
+	})
+
+	// Connect through the proxy and send a request...
+	c := dialSOCKS5(t, addr, up.Listener.Addr().(*net.TCPAddr), "user", "pass")
+	defer c.Close()
+	req, _ := http.NewRequest(http.MethodGet, up.URL, nil)
+	if err := req.Write(c); err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(c), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", res.StatusCode)
+	}
+}
+
+func TestSOCKS5WrongCredentials(t *testing.T) {
+	addr := serveSOCKS5(t, &proxy.ProxyConfig{}, &proxy.SOCKS5Config{Username: "user", Password: "pass"})
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// The server picks username/password authentication...
+	c.Write([]byte{0x05, 0x01, 0x02})
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(c, b); err != nil || b[1] != 0x02 {
+		t.Fatalf("unexpected method selection %v (%v)", b, err)
+	}
+
+	// ...rejects the wrong password with a non-zero status...
+	auth := append([]byte{0x01, 4}, "user"...)
+	auth = append(append(auth, 5), "wrong"...)
+	c.Write(auth)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatal(err)
+	}
+	if b[0] != 0x01 || b[1] == 0x00 {
+		t.Fatalf("expected authentication to fail, got %v", b)
+	}
+
+	// ...and closes the connection.
+	if _, err := c.Read(b); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+}
+
+func TestSOCKS5Rules(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+	dropped := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer dropped.Close()
+
+	// Drop connections to one destination only...
+	dst := dropped.Listener.Addr().(*net.TCPAddr)
+	addr := serveSOCKS5(t, &proxy.ProxyConfig{
+		Rules: []proxy.Rule{{
+			Name:   "drop",
+			Host:   dst.IP.String(),
+			Port:   strconv.Itoa(dst.Port),
+			Faults: proxy.Faults{ProbDrop: 1},
+		}},
+	}, &proxy.SOCKS5Config{Username: "user", Password: "pass"})
+
+	// ...so the other can be connected to...
+	c := dialSOCKS5(t, addr, up.Listener.Addr().(*net.TCPAddr), "user", "pass")
+	c.Close()
+
+	// ...but the connection is closed without a reply for the
+	// matching one.
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	authSOCKS5(t, c, "user", "pass")
+	rep, err := connectSOCKS5(c, dst)
+	if err != io.EOF {
+		t.Fatalf("expected the connection to be dropped, got reply %v (%v)", rep, err)
+	}
+}
+
+// serveSOCKS5 serves a SOCKS5 proxy, returning its address.
+func serveSOCKS5(t *testing.T, cfg *proxy.ProxyConfig, socks *proxy.SOCKS5Config) string {
+	t.Helper()
+	s, err := proxy.MakeSOCKS5Server(cfg, socks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go s.Serve(l)
+	return l.Addr().String()
+}
+
+// dialSOCKS5 connects to dst through the SOCKS5 proxy at addr.
+func dialSOCKS5(t *testing.T, addr string, dst *net.TCPAddr, user, pass string) net.Conn {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authSOCKS5(t, c, user, pass)
+	if rep, err := connectSOCKS5(c, dst); err != nil || rep[1] != 0x00 {
+		t.Fatalf("connect failed %v (%v)", rep, err)
+	}
+	return c
+}
+
+// authSOCKS5 authenticates with a username and password.
+func authSOCKS5(t *testing.T, c net.Conn, user, pass string) {
+	t.Helper()
+	c.Write([]byte{0x05, 0x01, 0x02})
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(c, b); err != nil || b[1] != 0x02 {
+		t.Fatalf("unexpected method selection %v (%v)", b, err)
+	}
+	auth := append([]byte{0x01, byte(len(user))}, user...)
+	auth = append(append(auth, byte(len(pass))), pass...)
+	c.Write(auth)
+	if _, err := io.ReadFull(c, b); err != nil || b[1] != 0x00 {
+		t.Fatalf("authentication failed %v (%v)", b, err)
+	}
+}
+
+// connectSOCKS5 sends a CONNECT request for dst, returning the reply.
+func connectSOCKS5(c net.Conn, dst *net.TCPAddr) ([]byte, error) {
+	req := append([]byte{0x05, 0x01, 0x00, 0x01}, dst.IP.To4()...)
+	req = binary.BigEndian.AppendUint16(req, uint16(dst.Port))
+	c.Write(req)
+	rep := make([]byte, 10)
+	_, err := io.ReadFull(c, rep)
+	return rep, err
+}
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"golang.org/x/exp/rand"
+)
+
+// ErrStreamCut is returned when reading a streamed response body
+// after red-tape has cut the stream short.
+var ErrStreamCut = errors.New("red-tape: stream cut")
+
+// StreamConfig configures faults for streamed responses. Server-Sent
+// Events responses are handled one event at a time and other
+// responses without a known length (e.g. chunked responses) are
+// handled one read from the upstream at a time.
+type StreamConfig struct {
+	// The rate of delay (sampled from an exponential distribution)
+	// before each event is passed on to the client
+	EventDelayRate float64 `mapstructure:"event-delay-rate"`
+
+	// The maximum delay before each event
+	EventDelayMax float64 `mapstructure:"event-delay-max"`
+
+	// The probability of dropping an individual event
+	ProbDropEvent float64 `mapstructure:"prob-drop-event"`
+
+	// Cut the stream after this many events (0 means never)
+	MaxEvents int `mapstructure:"max-events"`
+
+	// The probability of stalling when an SSE heartbeat (an event
+	// made up only of comments) is received
+	ProbStallHeartbeat float64 `mapstructure:"prob-stall-heartbeat"`
+
+	// How long to stall heartbeats for, in milliseconds
+	HeartbeatStall float64 `mapstructure:"heartbeat-stall"`
+}
+
+// isStream returns true if res's body should be handled as a stream.
+// If it's an SSE stream, sse is true.
+func isStream(res *http.Response) (stream bool, sse bool) {
+	mt, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if mt == "text/event-stream" {
+		return true, true
+	}
+	return res.ContentLength < 0, false
+}
+
+// streamBody wraps a streamed response body, injecting faults
+// between events.
+type streamBody struct {
+	rc     io.ReadCloser
+	br     *bufio.Reader
+	sse    bool
+	cfg    *StreamConfig
+	src    rand.Source
+	logger log.Logger
+	log    *RequestLog
+
+	buf    []byte // The pending event, not yet read
+	events int    // The number of events received
+	err    error  // The error to return once buf is empty
+
+	start  time.Time // When streaming started
+	closed bool
+}
+
+func newStreamBody(rc io.ReadCloser, sse bool, cfg *StreamConfig, src rand.Source, logger log.Logger, rl *RequestLog) *streamBody {
+	return &streamBody{
+		rc:     rc,
+		br:     bufio.NewReader(rc),
+		sse:    sse,
+		cfg:    cfg,
+		src:    src,
+		logger: logger,
+		log:    rl,
+		start:  time.Now(),
+	}
+}
+
+func (b *streamBody) Read(p []byte) (int, error) {
+	for len(b.buf) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		b.next()
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
+
+// Close closes the upstream body, recording the time spent streaming
+// as the throttle phase.
+func (b *streamBody) Close() error {
+	if !b.closed {
+		b.closed = true
+		b.log.phase(PhaseThrottle, b.start, time.Now())
+	}
+	return b.rc.Close()
+}
+
+// next reads the next event from the upstream into buf, applying
+// the stream faults.
+func (b *streamBody) next() {
+	// Should the stream be cut?
+	if b.cfg.MaxEvents > 0 && b.events >= b.cfg.MaxEvents {
+		b.logger.Debug("Cutting stream.", "events", b.events)
+		b.log.decide(Decision{Fault: FaultStreamCut, Value: strconv.Itoa(b.events)})
+		b.err = ErrStreamCut
+		return
+	}
+
+	// Read the next event...
+	var ev []byte
+	var err error
+	if b.sse {
+		ev, err = readEvent(b.br)
+	} else {
+		ev, err = readChunk(b.br)
+	}
+	b.err = err
+	if len(bytes.TrimSpace(ev)) == 0 {
+		b.buf = ev
+		return
+	}
+	b.events++
+
+	// Sleep before passing it on...
+	if b.sse && isHeartbeat(ev) && sampleProb(b.src, b.cfg.ProbStallHeartbeat) {
+		d := time.Duration(b.cfg.HeartbeatStall * float64(time.Millisecond))
+		b.logger.Debug("Stalling heartbeat.", "delay", d)
+		b.log.decide(Decision{Fault: FaultHeartbeatStall, Delay: d})
+		time.Sleep(d)
+	} else {
+		d := sampleDelay(b.src, b.cfg.EventDelayRate, b.cfg.EventDelayMax)
+		b.logger.Debug("Delaying event.", "delay", d)
+		b.log.delay(FaultEventDelay, d)
+		time.Sleep(d)
+	}
+
+	// Should the event be dropped?
+	if sampleProb(b.src, b.cfg.ProbDropEvent) {
+		b.logger.Debug("Dropping event.", "event", b.events)
+		b.log.decide(Decision{Fault: FaultDropEvent, Value: strconv.Itoa(b.events)})
+		return
+	}
+	b.buf = ev
+}
+
+// readEvent reads a single SSE event, including the blank line
+// that ends it.
+func readEvent(br *bufio.Reader) ([]byte, error) {
+	var ev []byte
+	for {
+		line, err := br.ReadBytes('\n')
+		ev = append(ev, line...)
+		if err != nil {
+			return ev, err
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return ev, nil
+		}
+	}
+}
+
+// readChunk reads whatever data is available from the upstream.
+func readChunk(br *bufio.Reader) ([]byte, error) {
+	buf := make([]byte, 32*1024)
+	n, err := br.Read(buf)
+	return buf[:n], err
+}
+
+// isHeartbeat returns true if the SSE event is made up of only
+// comment lines.
+func isHeartbeat(ev []byte) bool {
+	comment := false
+	for _, line := range bytes.Split(ev, []byte("\n")) {
+		line = bytes.TrimRight(line, "\r")
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != ':' {
+			return false
+		}
+		comment = true
+	}
+	return comment
+}
@@ -0,0 +1,70 @@
+package proxy_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/a-poor/red-tape/pkg/proxy"
+)
+
+func TestStreamCutAfterEvents(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 5; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer up.Close()
+
+	rt, err := proxy.MakeRoundTripper(&proxy.ProxyConfig{
+		DestURL: up.URL,
+		Faults:  proxy.Faults{Stream: &proxy.StreamConfig{MaxEvents: 2}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, up.URL, nil)
+	res, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != proxy.ErrStreamCut {
+		t.Fatalf("expected ErrStreamCut, got %v", err)
+	}
+	if string(b) != "data: 0\n\ndata: 1\n\n" {
+		t.Fatalf("unexpected body %q", b)
+	}
+}
+
+func TestStreamDropEvents(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, ": ping\n\ndata: a\n\n")
+	}))
+	defer up.Close()
+
+	rt, err := proxy.MakeRoundTripper(&proxy.ProxyConfig{
+		DestURL: up.URL,
+		Faults:  proxy.Faults{Stream: &proxy.StreamConfig{ProbDropEvent: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, up.URL, nil)
+	res, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if b, _ := io.ReadAll(res.Body); len(b) != 0 {
+		t.Fatalf("expected every event to be dropped, got %q", b)
+	}
+}
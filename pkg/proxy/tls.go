@@ -0,0 +1,349 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// The file names used to store a generated CA in ServerTLSConfig.CADir.
+const (
+	CACertFile = "ca.crt"
+	CAKeyFile  = "ca.key"
+)
+
+// The host name used for certificates served by the wrong-host fault.
+const wrongHostName = "wrong-host.red-tape.invalid"
+
+// ErrHandshakeFault is returned from the TLS handshake when red-tape
+// decides to fail it on purpose.
+var ErrHandshakeFault = errors.New("red-tape: injected tls handshake failure")
+
+// ServerTLSConfig configures how red-tape terminates TLS for incoming
+// connections, along with the TLS-level faults it injects.
+type ServerTLSConfig struct {
+	// Paths to a PEM-encoded certificate and key to serve. If they're
+	// empty, a certificate is issued from a local CA instead.
+	CertFile string `mapstructure:"cert-file"`
+	KeyFile  string `mapstructure:"key-file"`
+
+	// The directory holding the local CA's certificate and key. If
+	// they don't exist yet, a self-signed CA is generated and written
+	// there. If empty, a "red-tape" directory in the user's config
+	// directory is used.
+	CADir string `mapstructure:"ca-dir"`
+
+	// Host names and IP addresses for certificates issued by the
+	// local CA (defaults to localhost, 127.0.0.1 and ::1)
+	Hosts []string `mapstructure:"hosts"`
+
+	// The rate of handshake delay (sampled from an exponential
+	// distribution) before the server's certificate is sent
+	HandshakeDelayRate float64 `mapstructure:"handshake-delay-rate"`
+
+	// The maximum handshake delay
+	HandshakeDelayMax float64 `mapstructure:"handshake-delay-max"`
+
+	// The probability of failing the handshake outright
+	ProbHandshakeFail float64 `mapstructure:"prob-handshake-fail"`
+
+	// The probability of serving an expired certificate
+	ProbExpiredCert float64 `mapstructure:"prob-expired-cert"`
+
+	// The probability of serving a certificate for the wrong host
+	ProbWrongHostCert float64 `mapstructure:"prob-wrong-host-cert"`
+
+	// An optional seed for the random number generator
+	// (0 is treated as no seed)
+	Seed uint64 `mapstructure:"-"`
+
+	// Logger to use
+	Logger log.Logger `mapstructure:"-"`
+}
+
+// UpstreamTLSConfig configures how red-tape connects to HTTPS upstreams.
+type UpstreamTLSConfig struct {
+	// Path to a PEM bundle of CA certificates to trust, instead of the
+	// system's root CAs
+	CAFile string `mapstructure:"ca-file"`
+
+	// Paths to a PEM-encoded client certificate and key to present to
+	// the upstream (for mTLS)
+	CertFile string `mapstructure:"cert-file"`
+	KeyFile  string `mapstructure:"key-file"`
+
+	// Overrides the server name used to verify the upstream's certificate
+	ServerName string `mapstructure:"server-name"`
+
+	// Skip verifying the upstream's certificate chain and host name
+	InsecureSkipVerify bool `mapstructure:"insecure-skip-verify"`
+}
+
+// CA is a certificate authority used to issue certificates for
+// red-tape's TLS listener.
+type CA struct {
+	Cert *x509.Certificate
+	Key  *ecdsa.PrivateKey
+}
+
+// LoadOrCreateCA loads the CA stored in dir, generating and saving
+// a new self-signed CA if one doesn't exist yet.
+func LoadOrCreateCA(dir string) (*CA, error) {
+	certPath := filepath.Join(dir, CACertFile)
+	keyPath := filepath.Join(dir, CAKeyFile)
+
+	// Load the existing CA, if there is one...
+	if _, err := os.Stat(certPath); err == nil {
+		pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("loading ca: %w", err)
+		}
+		cert, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("parsing ca certificate: %w", err)
+		}
+		key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("ca key in %q must be an ecdsa key", keyPath)
+		}
+		return &CA{Cert: cert, Key: key}, nil
+	}
+
+	// Otherwise generate a new one...
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          newSerial(),
+		Subject:               pkix.Name{CommonName: "red-tape local CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	// ...and write it to disk...
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	if err := writePEM(certPath, "CERTIFICATE", der, 0o644); err != nil {
+		return nil, err
+	}
+	if err := writePEM(keyPath, "EC PRIVATE KEY", keyDER, 0o600); err != nil {
+		return nil, err
+	}
+	return &CA{Cert: cert, Key: key}, nil
+}
+
+// Issue creates a leaf certificate for the given hosts, valid
+// between notBefore and notAfter.
+func (ca *CA) Issue(hosts []string, notBefore, notAfter time.Time) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: newSerial(),
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	if len(hosts) > 0 {
+		tmpl.Subject = pkix.Name{CommonName: hosts[0]}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Cert, &key.PublicKey, ca.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.Cert.Raw},
+		PrivateKey:  key,
+	}, nil
+}
+
+// MakeServerTLSConfig creates the tls.Config used to terminate TLS
+// for incoming connections, with cfg's TLS faults applied.
+func MakeServerTLSConfig(cfg *ServerTLSConfig) (*tls.Config, error) {
+	// Get the logger...
+	logger := cfg.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	// A certificate needs its key...
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, errors.New("the tls cert file and key file must be set together")
+	}
+
+	// Get the host names to issue certificates for...
+	hosts := cfg.Hosts
+	if len(hosts) == 0 {
+		hosts = []string{"localhost", "127.0.0.1", "::1"}
+	}
+
+	// The local CA is needed to issue a certificate if one wasn't
+	// given, or to issue the faulty certificates...
+	var ca *CA
+	if cfg.CertFile == "" || cfg.ProbExpiredCert > 0 || cfg.ProbWrongHostCert > 0 {
+		dir := cfg.CADir
+		if dir == "" {
+			d, err := os.UserConfigDir()
+			if err != nil {
+				return nil, err
+			}
+			dir = filepath.Join(d, "red-tape")
+		}
+		var err error
+		if ca, err = LoadOrCreateCA(dir); err != nil {
+			return nil, err
+		}
+		logger.Debug("Loaded local CA.", "dir", dir)
+	}
+
+	// Load or issue the certificate to serve...
+	now := time.Now()
+	var cert *tls.Certificate
+	if cfg.CertFile != "" {
+		c, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cert = &c
+	} else {
+		c, err := ca.Issue(hosts, now.Add(-time.Hour), now.AddDate(1, 0, 0))
+		if err != nil {
+			return nil, err
+		}
+		cert = c
+	}
+
+	// Issue the faulty certificates, if they're needed...
+	var expired, wrongHost *tls.Certificate
+	if cfg.ProbExpiredCert > 0 {
+		c, err := ca.Issue(hosts, now.AddDate(0, 0, -30), now.AddDate(0, 0, -1))
+		if err != nil {
+			return nil, err
+		}
+		expired = c
+	}
+	if cfg.ProbWrongHostCert > 0 {
+		c, err := ca.Issue([]string{wrongHostName}, now.Add(-time.Hour), now.AddDate(1, 0, 0))
+		if err != nil {
+			return nil, err
+		}
+		wrongHost = c
+	}
+
+	// Pick the certificate for each handshake...
+	src := newSource(cfg.Seed)
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			// Sleep before responding...
+			d := sampleDelay(src, cfg.HandshakeDelayRate, cfg.HandshakeDelayMax)
+			logger.Debug("Delaying tls handshake.", "delay", d, "server_name", hello.ServerName)
+			time.Sleep(d)
+
+			// Should the handshake fail?
+			if sampleProb(src, cfg.ProbHandshakeFail) {
+				logger.Debug("Failing tls handshake.", "server_name", hello.ServerName)
+				return nil, ErrHandshakeFault
+			}
+
+			// Should a bad certificate be served?
+			if sampleProb(src, cfg.ProbExpiredCert) {
+				logger.Debug("Serving expired certificate.", "server_name", hello.ServerName)
+				return expired, nil
+			}
+			if sampleProb(src, cfg.ProbWrongHostCert) {
+				logger.Debug("Serving wrong-host certificate.", "server_name", hello.ServerName)
+				return wrongHost, nil
+			}
+			return cert, nil
+		},
+	}, nil
+}
+
+// MakeUpstreamTLSConfig creates the tls.Config used when connecting
+// to HTTPS upstreams.
+func MakeUpstreamTLSConfig(cfg *UpstreamTLSConfig) (*tls.Config, error) {
+	tc := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	// Load the CA bundle...
+	if cfg.CAFile != "" {
+		b, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in %q", cfg.CAFile)
+		}
+		tc.RootCAs = pool
+	}
+
+	// Load the client certificate...
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, errors.New("the upstream cert file and key file must be set together")
+	}
+	if cfg.CertFile != "" {
+		c, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tc.Certificates = []tls.Certificate{c}
+	}
+	return tc, nil
+}
+
+func newSerial() *big.Int {
+	n, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func writePEM(path, typ string, der []byte, perm os.FileMode) error {
+	b := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	return os.WriteFile(path, b, perm)
+}
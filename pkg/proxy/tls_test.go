@@ -0,0 +1,229 @@
+package proxy_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/a-poor/red-tape/pkg/proxy"
+)
+
+func TestServerTLSGeneratedCA(t *testing.T) {
+	dir := t.TempDir()
+	tc, err := proxy.MakeServerTLSConfig(&proxy.ServerTLSConfig{CADir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Serve over TLS with the generated certificate...
+	u := serveTLS(t, tc, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	// The CA should have been written to disk and trusted by a client...
+	ca, err := proxy.LoadOrCreateCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Cert)
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	res, err := c.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d", res.StatusCode)
+	}
+	if _, err := tls.LoadX509KeyPair(filepath.Join(dir, proxy.CACertFile), filepath.Join(dir, proxy.CAKeyFile)); err != nil {
+		t.Fatalf("expected ca files on disk: %s", err)
+	}
+}
+
+func TestServerTLSHandshakeFault(t *testing.T) {
+	tc, err := proxy.MakeServerTLSConfig(&proxy.ServerTLSConfig{
+		CADir:             t.TempDir(),
+		ProbHandshakeFail: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := serveTLS(t, tc, http.NotFoundHandler())
+
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	if _, err := c.Get(u); err == nil {
+		t.Fatal("expected the handshake to fail")
+	}
+}
+
+func TestServerTLSBadCerts(t *testing.T) {
+	tests := []struct {
+		name  string
+		cfg   proxy.ServerTLSConfig
+		check func(err error) bool
+	}{
+		{"expired", proxy.ServerTLSConfig{ProbExpiredCert: 1}, func(err error) bool {
+			var ce x509.CertificateInvalidError
+			return errors.As(err, &ce) && ce.Reason == x509.Expired
+		}},
+		{"wrong-host", proxy.ServerTLSConfig{ProbWrongHostCert: 1}, func(err error) bool {
+			var he x509.HostnameError
+			return errors.As(err, &he)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := tt.cfg
+			cfg.CADir = dir
+			tc, err := proxy.MakeServerTLSConfig(&cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u := serveTLS(t, tc, http.NotFoundHandler())
+
+			// The certificate is issued by the trusted CA, but is
+			// still rejected...
+			ca, err := proxy.LoadOrCreateCA(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pool := x509.NewCertPool()
+			pool.AddCert(ca.Cert)
+			c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+			_, err = c.Get(u)
+			if !tt.check(err) {
+				t.Fatalf("expected a %s certificate error, got %v", tt.name, err)
+			}
+		})
+	}
+}
+
+func TestServerTLSCertWithoutKey(t *testing.T) {
+	_, err := proxy.MakeServerTLSConfig(&proxy.ServerTLSConfig{
+		CADir:    t.TempDir(),
+		CertFile: "server.crt",
+	})
+	if err == nil {
+		t.Fatal("expected an error for a cert file without a key file")
+	}
+}
+
+func TestUpstreamTLS(t *testing.T) {
+	// Issue the upstream's certificate and a client certificate from
+	// a local CA...
+	dir := t.TempDir()
+	ca, err := proxy.LoadOrCreateCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	serverCert, err := ca.Issue([]string{"upstream.test"}, now.Add(-time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := ca.Issue([]string{"client.test"}, now.Add(-time.Hour), now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := writeKeyPair(t, dir, clientCert)
+
+	// ...and serve, requiring a client certificate...
+	up := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 || r.TLS.PeerCertificates[0].Subject.CommonName != "client.test" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	up.TLS = &tls.Config{
+		Certificates: []tls.Certificate{*serverCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	}
+	up.StartTLS()
+	defer up.Close()
+
+	// The upstream is trusted with the CA file and server name, and
+	// accepts the client certificate...
+	tc, err := proxy.MakeUpstreamTLSConfig(&proxy.UpstreamTLSConfig{
+		CAFile:     filepath.Join(dir, proxy.CACertFile),
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+		ServerName: "upstream.test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: tc}}
+	res, err := c.Get(up.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", res.StatusCode)
+	}
+
+	// ...but not without the server name.
+	tc, err = proxy.MakeUpstreamTLSConfig(&proxy.UpstreamTLSConfig{
+		CAFile:   filepath.Join(dir, proxy.CACertFile),
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = &http.Client{Transport: &http.Transport{TLSClientConfig: tc}}
+	if _, err := c.Get(up.URL); err == nil {
+		t.Fatal("expected the upstream's certificate to be rejected")
+	}
+}
+
+func TestUpstreamTLSCertWithoutKey(t *testing.T) {
+	_, err := proxy.MakeUpstreamTLSConfig(&proxy.UpstreamTLSConfig{CertFile: "client.crt"})
+	if err == nil {
+		t.Fatal("expected an error for a cert file without a key file")
+	}
+}
+
+// writeKeyPair writes c's certificate chain and key to PEM files in
+// dir, returning their paths.
+func writeKeyPair(t *testing.T, dir string, c *tls.Certificate) (string, string) {
+	t.Helper()
+	var certPEM []byte
+	for _, der := range c.Certificate {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(c.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	if err := os.WriteFile(certFile, certPEM, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// serveTLS serves h with red-tape's TLS listener, returning its URL.
+func serveTLS(t *testing.T, tc *tls.Config, h http.Handler) string {
+	l, err := proxy.Listen(&proxy.ListenConfig{Addr: "127.0.0.1:0", TLS: tc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: h}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return "https://" + l.Addr().String()
+}
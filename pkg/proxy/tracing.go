@@ -0,0 +1,357 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// The OTLP span kinds and status codes used by the Tracer.
+const (
+	otlpKindInternal = 1
+	otlpKindServer   = 2
+	otlpKindClient   = 3
+
+	otlpStatusError = 2
+)
+
+// TracingConfig configures exporting OpenTelemetry spans.
+type TracingConfig struct {
+	// The OTLP/HTTP traces endpoint to export spans to
+	// (e.g. "http://localhost:4318/v1/traces")
+	Endpoint string `mapstructure:"endpoint"`
+
+	// Extra headers to send with each export (e.g. for auth)
+	Headers map[string]string `mapstructure:"headers"`
+
+	// The service name reported for red-tape's spans (defaults to
+	// "red-tape")
+	ServiceName string `mapstructure:"service-name"`
+
+	// How often to export batches of spans (defaults to 1s)
+	FlushInterval time.Duration `mapstructure:"flush-interval"`
+
+	// The maximum number of spans per export (defaults to 512)
+	BatchSize int `mapstructure:"batch-size"`
+
+	// Logger to use
+	Logger log.Logger `mapstructure:"-"`
+}
+
+// Tracer joins incoming W3C trace contexts and exports a span for
+// each request, with child spans for each phase (the delays, the
+// upstream round trip and throttling) and span events for each fault.
+// Spans are exported in batches with OTLP/HTTP, as JSON.
+type Tracer struct {
+	cfg    TracingConfig
+	client *http.Client
+	logger log.Logger
+
+	mu      sync.Mutex
+	pending []otlpSpan
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// MakeTracer creates a Tracer and starts exporting spans.
+func MakeTracer(cfg *TracingConfig) (*Tracer, error) {
+	if cfg.Endpoint == "" {
+		return nil, fmt.Errorf("tracing endpoint is required")
+	}
+	t := &Tracer{
+		cfg:    *cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		logger: cfg.Logger,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if t.logger == nil {
+		t.logger = log.Default()
+	}
+	if t.cfg.ServiceName == "" {
+		t.cfg.ServiceName = "red-tape"
+	}
+	if t.cfg.FlushInterval <= 0 {
+		t.cfg.FlushInterval = time.Second
+	}
+	if t.cfg.BatchSize <= 0 {
+		t.cfg.BatchSize = 512
+	}
+	go t.run()
+	return t, nil
+}
+
+// Close exports any pending spans and stops the Tracer.
+func (t *Tracer) Close() error {
+	close(t.stop)
+	<-t.done
+	return nil
+}
+
+// start joins r's incoming trace context (or starts a new trace) and
+// returns a copy of r that propagates it to the upstream.
+func (t *Tracer) start(l *RequestLog, r *http.Request) *http.Request {
+	traceID, parentID, ok := parseTraceparent(r.Header.Get("traceparent"))
+	if !ok {
+		traceID = newID(16)
+	}
+	l.TraceID = traceID
+	l.ParentSpanID = parentID
+	l.SpanID = newID(8)
+	l.upstreamSpanID = newID(8)
+
+	// Propagate the upstream span...
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Header = r.Header.Clone()
+	r2.Header.Set("traceparent", "00-"+traceID+"-"+l.upstreamSpanID+"-01")
+	return r2
+}
+
+// Observe queues the spans for a completed request.
+func (t *Tracer) Observe(l *RequestLog) {
+	if l.TraceID == "" {
+		return
+	}
+
+	// Create the request's span...
+	end := l.Start.Add(l.Duration)
+	root := otlpSpan{
+		TraceID:      l.TraceID,
+		SpanID:       l.SpanID,
+		ParentSpanID: l.ParentSpanID,
+		Name:         "red-tape " + l.Method,
+		Kind:         otlpKindServer,
+		Start:        otlpTime(l.Start),
+		End:          otlpTime(end),
+		Attributes: []otlpKeyValue{
+			otlpString("http.request.method", l.Method),
+			otlpString("url.full", l.URL),
+			otlpString("client.address", clientIP(l.ClientAddr)),
+			otlpString("server.address", l.Upstream),
+			otlpString("red_tape.rule", l.Rule),
+			otlpString("red_tape.added_delay", l.AddedDelay().String()),
+		},
+	}
+	if l.Status != 0 {
+		root.Attributes = append(root.Attributes, otlpInt("http.response.status_code", l.Status))
+	}
+	if l.Err != nil {
+		root.Status = &otlpStatus{Code: otlpStatusError, Message: l.Err.Error()}
+	}
+	for _, d := range l.Decisions() {
+		ev := otlpEvent{Name: "red_tape.fault." + d.Fault, Time: otlpTime(d.At)}
+		if d.Delay > 0 {
+			ev.Attributes = append(ev.Attributes, otlpString("red_tape.delay", d.Delay.String()))
+		}
+		if d.Value != "" {
+			ev.Attributes = append(ev.Attributes, otlpString("red_tape.value", d.Value))
+		}
+		root.Events = append(root.Events, ev)
+	}
+	spans := []otlpSpan{root}
+
+	// ...and a child span for each phase...
+	for _, p := range l.Phases() {
+		s := otlpSpan{
+			TraceID:      l.TraceID,
+			SpanID:       newID(8),
+			ParentSpanID: l.SpanID,
+			Name:         p.Name,
+			Kind:         otlpKindInternal,
+			Start:        otlpTime(p.Start),
+			End:          otlpTime(p.End),
+		}
+		if p.Name == PhaseUpstream {
+			s.SpanID = l.upstreamSpanID
+			s.Kind = otlpKindClient
+		}
+		spans = append(spans, s)
+	}
+
+	t.mu.Lock()
+	t.pending = append(t.pending, spans...)
+	full := len(t.pending) >= t.cfg.BatchSize
+	t.mu.Unlock()
+	if full {
+		go t.flush()
+	}
+}
+
+// run exports spans periodically until the Tracer is closed.
+func (t *Tracer) run() {
+	defer close(t.done)
+	tick := time.NewTicker(t.cfg.FlushInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			t.flush()
+		case <-t.stop:
+			t.flush()
+			return
+		}
+	}
+}
+
+// flush exports the pending spans.
+func (t *Tracer) flush() {
+	t.mu.Lock()
+	spans := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+
+	for len(spans) > 0 {
+		n := len(spans)
+		if n > t.cfg.BatchSize {
+			n = t.cfg.BatchSize
+		}
+		if err := t.export(spans[:n]); err != nil {
+			t.logger.Error("Failed to export spans.", "endpoint", t.cfg.Endpoint, "err", err)
+		}
+		spans = spans[n:]
+	}
+}
+
+// export sends spans to the collector.
+func (t *Tracer) export(spans []otlpSpan) error {
+	body, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{
+			otlpString("service.name", t.cfg.ServiceName),
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/a-poor/red-tape"},
+			Spans: spans,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	res, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("collector returned status %d", res.StatusCode)
+	}
+	return nil
+}
+
+// parseTraceparent parses a W3C traceparent header, returning its
+// trace ID and parent span ID.
+func parseTraceparent(h string) (string, string, bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return "", "", false
+	}
+	traceID, spanID := parts[1], parts[2]
+	if !isHexID(traceID, 32) || !isHexID(spanID, 16) {
+		return "", "", false
+	}
+	return traceID, spanID, true
+}
+
+// isHexID returns true if s is a valid, non-zero, lowercase hex ID
+// of length n.
+func isHexID(s string, n int) bool {
+	if len(s) != n || strings.Trim(s, "0") == "" {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// newID returns a random hex-encoded ID of n bytes.
+func newID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// The OTLP/HTTP JSON types used for exporting spans.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID      string         `json:"traceId"`
+		SpanID       string         `json:"spanId"`
+		ParentSpanID string         `json:"parentSpanId,omitempty"`
+		Name         string         `json:"name"`
+		Kind         int            `json:"kind"`
+		Start        string         `json:"startTimeUnixNano"`
+		End          string         `json:"endTimeUnixNano"`
+		Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+		Events       []otlpEvent    `json:"events,omitempty"`
+		Status       *otlpStatus    `json:"status,omitempty"`
+	}
+	otlpEvent struct {
+		Name       string         `json:"name"`
+		Time       string         `json:"timeUnixNano"`
+		Attributes []otlpKeyValue `json:"attributes,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string `json:"stringValue,omitempty"`
+		IntValue    *string `json:"intValue,omitempty"`
+	}
+)
+
+func otlpString(k, v string) otlpKeyValue {
+	return otlpKeyValue{Key: k, Value: otlpValue{StringValue: &v}}
+}
+
+func otlpInt(k string, v int) otlpKeyValue {
+	s := strconv.Itoa(v)
+	return otlpKeyValue{Key: k, Value: otlpValue{IntValue: &s}}
+}
+
+func otlpTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
@@ -0,0 +1,104 @@
+package proxy_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/a-poor/red-tape/pkg/proxy"
+)
+
+func TestTracing(t *testing.T) {
+	// Record the traceparent the upstream receives...
+	var upstreamParent string
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamParent = r.Header.Get("traceparent")
+	}))
+	defer up.Close()
+
+	// Stand in for an OTLP collector...
+	var mu sync.Mutex
+	var spans []struct {
+		TraceID      string `json:"traceId"`
+		SpanID       string `json:"spanId"`
+		ParentSpanID string `json:"parentSpanId"`
+		Name         string `json:"name"`
+		Events       []struct {
+			Name string `json:"name"`
+		} `json:"events"`
+	}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans json.RawMessage `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				if err := json.Unmarshal(ss.Spans, &spans); err != nil {
+					t.Error(err)
+				}
+			}
+		}
+	}))
+	defer collector.Close()
+
+	tr, err := proxy.MakeTracer(&proxy.TracingConfig{Endpoint: collector.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt, err := proxy.MakeRoundTripper(&proxy.ProxyConfig{
+		Faults: proxy.Faults{PreDelayRate: 1, PreDelayMax: 1},
+		Tracer: tr,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Send a request with an incoming trace context...
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, _ := http.NewRequest(http.MethodGet, up.URL, nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	res, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(res.Body)
+	res.Body.Close()
+	tr.Close()
+
+	// Check the spans...
+	mu.Lock()
+	defer mu.Unlock()
+	names := map[string]string{}
+	var root string
+	for _, s := range spans {
+		if s.TraceID != traceID {
+			t.Errorf("expected span %q in trace %s, got %s", s.Name, traceID, s.TraceID)
+		}
+		names[s.Name] = s.SpanID
+		if s.ParentSpanID == "00f067aa0ba902b7" {
+			root = s.SpanID
+			if len(s.Events) != 1 || s.Events[0].Name != "red_tape.fault.pre-delay" {
+				t.Errorf("expected a pre-delay fault event, got %+v", s.Events)
+			}
+		}
+	}
+	if root == "" || names[proxy.PhasePreDelay] == "" || names[proxy.PhaseUpstream] == "" {
+		t.Fatalf("expected request, pre-delay and upstream spans, got %+v", spans)
+	}
+	if !strings.Contains(upstreamParent, names[proxy.PhaseUpstream]) {
+		t.Fatalf("expected the upstream span %s to be propagated, got %q", names[proxy.PhaseUpstream], upstreamParent)
+	}
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+
+	"github.com/charmbracelet/log"
+	"golang.org/x/exp/rand"
+)
+
+// The kinds of network error that can be injected.
+const (
+	NetErrorTimeout     = "timeout"
+	NetErrorConnReset   = "conn-reset"
+	NetErrorConnRefused = "conn-refused"
+	NetErrorDNS         = "dns"
+)
+
+// netErrorKinds are the kinds of network error injected by default.
+var netErrorKinds = []string{NetErrorTimeout, NetErrorConnReset, NetErrorConnRefused, NetErrorDNS}
+
+// netError creates an error like the one the net package returns for
+// a kind of network failure, so it can be checked for in the usual
+// ways (e.g. with errors.Is(err, syscall.ECONNRESET) or a net.Error's
+// Timeout method).
+func netError(kind, host string) error {
+	switch kind {
+	case NetErrorConnReset:
+		return &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	case NetErrorConnRefused:
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	case NetErrorDNS:
+		return &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}}
+	default:
+		return &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	}
+}
+
+// pickNetError picks one of the kinds of network error (or any kind,
+// if none are given).
+func pickNetError(src rand.Source, kinds []string) string {
+	if len(kinds) == 0 {
+		kinds = netErrorKinds
+	}
+	return kinds[rand.New(src).Intn(len(kinds))]
+}
+
+// TransportOption configures a transport created with NewTransport.
+type TransportOption func(cfg *ProxyConfig)
+
+// WithFaults sets all the faults at once.
+func WithFaults(f Faults) TransportOption {
+	return func(cfg *ProxyConfig) { cfg.Faults = f }
+}
+
+// WithDelay adds an exponential delay before each request is sent,
+// with the given rate (1/ms) and maximum (ms).
+func WithDelay(rate, max float64) TransportOption {
+	return func(cfg *ProxyConfig) {
+		cfg.PreDelayRate = rate
+		cfg.PreDelayMax = max
+	}
+}
+
+// WithResponseDelay adds an exponential delay after each response is
+// received, with the given rate (1/ms) and maximum (ms).
+func WithResponseDelay(rate, max float64) TransportOption {
+	return func(cfg *ProxyConfig) {
+		cfg.PostDelayRate = rate
+		cfg.PostDelayMax = max
+	}
+}
+
+// WithErrors fails requests with probability p, with one of the
+// given kinds of network error (NetErrorTimeout, NetErrorConnReset,
+// NetErrorConnRefused or NetErrorDNS). With no kinds, any of them
+// can be returned.
+func WithErrors(p float64, kinds ...string) TransportOption {
+	return func(cfg *ProxyConfig) {
+		cfg.ProbNetError = p
+		cfg.NetErrors = kinds
+	}
+}
+
+// WithStatus responds to requests with probability p with the given
+// status, without sending them.
+func WithStatus(p float64, status int) TransportOption {
+	return func(cfg *ProxyConfig) {
+		cfg.ProbError = p
+		cfg.ErrorStatus = status
+	}
+}
+
+// WithDrop fails requests with ErrDropped, with probability p.
+func WithDrop(p float64) TransportOption {
+	return func(cfg *ProxyConfig) { cfg.ProbDrop = p }
+}
+
+// WithFault adds a custom fault to the end of the pipeline (after
+// the built-in faults, unless the pipeline was already set).
+func WithFault(f Fault) TransportOption {
+	return func(cfg *ProxyConfig) {
+		if cfg.Pipeline == nil {
+			cfg.Pipeline = DefaultPipeline()
+		}
+		cfg.Pipeline = append(cfg.Pipeline, f)
+	}
+}
+
+// WithSeed seeds the random number generator, so faults are
+// repeatable.
+func WithSeed(seed uint64) TransportOption {
+	return func(cfg *ProxyConfig) { cfg.Seed = seed }
+}
+
+// WithLogger logs the transport's decisions (they're discarded by
+// default).
+func WithLogger(logger log.Logger) TransportOption {
+	return func(cfg *ProxyConfig) { cfg.Logger = logger }
+}
+
+// WithObserver passes each completed request's RequestLog to o.
+func WithObserver(o Observer) TransportOption {
+	return func(cfg *ProxyConfig) { cfg.Observers = append(cfg.Observers, o) }
+}
+
+// NewTransport wraps base (or http.DefaultTransport, if it's nil)
+// with faults, for use in an http.Client. For example:
+//
+//	rt, err := proxy.NewTransport(nil,
+//		proxy.WithDelay(0.01, 500),
+//		proxy.WithErrors(0.1, proxy.NetErrorConnReset),
+//	)
+//	if err != nil {
+//		return err
+//	}
+//	client := &http.Client{Transport: rt}
+//
+// An error is returned if the options are invalid.
+func NewTransport(base http.RoundTripper, opts ...TransportOption) (http.RoundTripper, error) {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	cfg := &ProxyConfig{
+		Transport: base,
+		Logger:    log.New(log.WithOutput(io.Discard)),
+	}
+	for _, o := range opts {
+		o(cfg)
+	}
+	return MakeRoundTripper(cfg)
+}
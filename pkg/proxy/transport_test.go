@@ -0,0 +1,77 @@
+package proxy_test
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/a-poor/red-tape/pkg/proxy"
+)
+
+func TestTransportErrors(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+
+	tests := []struct {
+		kind  string
+		check func(err error) bool
+	}{
+		{proxy.NetErrorTimeout, func(err error) bool {
+			var ne net.Error
+			return errors.As(err, &ne) && ne.Timeout() && errors.Is(err, os.ErrDeadlineExceeded)
+		}},
+		{proxy.NetErrorConnReset, func(err error) bool { return errors.Is(err, syscall.ECONNRESET) }},
+		{proxy.NetErrorConnRefused, func(err error) bool { return errors.Is(err, syscall.ECONNREFUSED) }},
+		{proxy.NetErrorDNS, func(err error) bool {
+			var de *net.DNSError
+			return errors.As(err, &de) && de.IsNotFound
+		}},
+	}
+	for _, tt := range tests {
+		rt, err := proxy.NewTransport(nil, proxy.WithErrors(1, tt.kind))
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := &http.Client{Transport: rt}
+		_, err = client.Get(up.URL)
+		if err == nil || !tt.check(err) {
+			t.Errorf("%s: unexpected error %v", tt.kind, err)
+		}
+	}
+}
+
+func TestTransportOptions(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+
+	rt, err := proxy.NewTransport(nil, proxy.WithDrop(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: rt}
+	if _, err := client.Get(up.URL); !errors.Is(err, proxy.ErrDropped) {
+		t.Errorf("expected ErrDropped, got %v", err)
+	}
+
+	rt, err = proxy.NewTransport(nil, proxy.WithStatus(1, http.StatusTooManyRequests))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = &http.Client{Transport: rt}
+	res, err := client.Get(up.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected status 429, got %d", res.StatusCode)
+	}
+
+	if _, err := proxy.NewTransport(nil, proxy.WithErrors(1, "nope")); err == nil {
+		t.Error("expected an error for an unknown network error")
+	}
+}
@@ -0,0 +1,218 @@
+// Package redtapetest runs red-tape in-process, for Go test suites.
+//
+// For example, to check a client retries failed requests:
+//
+//	func TestRetries(t *testing.T) {
+//		rt := redtapetest.NewServer(t, upstream.URL,
+//			redtapetest.WithFaults(proxy.Faults{ProbError: 1}),
+//		)
+//		callClient(rt.URL)
+//		rt.AssertRetries(t, 3, redtapetest.Path("/api"))
+//	}
+package redtapetest
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/a-poor/red-tape/pkg/proxy"
+)
+
+// RuleTest is the rule name recorded for requests using faults set
+// with Server.SetFaults.
+const RuleTest = "redtapetest"
+
+// WaitTimeout is how long assertions wait for requests to be
+// completed, since requests are only recorded once red-tape has
+// closed the response body.
+var WaitTimeout = time.Second
+
+// Option configures a Server.
+type Option func(cfg *proxy.ProxyConfig)
+
+// WithFaults sets the default faults.
+func WithFaults(f proxy.Faults) Option {
+	return func(cfg *proxy.ProxyConfig) { cfg.Faults = f }
+}
+
+// WithRules sets the rules overriding the default faults.
+func WithRules(rules ...proxy.Rule) Option {
+	return func(cfg *proxy.ProxyConfig) { cfg.Rules = rules }
+}
+
+// WithSeed seeds the random number generator, so tests are
+// repeatable.
+func WithSeed(seed uint64) Option {
+	return func(cfg *proxy.ProxyConfig) { cfg.Seed = seed }
+}
+
+// WithConfig changes any other part of the proxy's config.
+func WithConfig(fn func(cfg *proxy.ProxyConfig)) Option {
+	return fn
+}
+
+// Server is an in-process red-tape reverse proxy.
+type Server struct {
+	// The proxy's URL, to send requests to instead of the upstream
+	URL string
+
+	live *proxy.LiveFaults
+
+	mu   sync.Mutex
+	logs []*proxy.RequestLog
+}
+
+// NewServer starts a red-tape reverse proxy to upstreamURL, on a
+// random port. It's closed when the test finishes.
+func NewServer(t testing.TB, upstreamURL string, opts ...Option) *Server {
+	t.Helper()
+	s := &Server{live: &proxy.LiveFaults{}}
+	cfg := &proxy.ProxyConfig{
+		DestURL: upstreamURL,
+		Live:    s.live,
+	}
+	for _, o := range opts {
+		o(cfg)
+	}
+	cfg.Observers = append(cfg.Observers, s)
+
+	p, err := proxy.MakeProxy(cfg)
+	if err != nil {
+		t.Fatalf("redtapetest: %v", err)
+	}
+	srv := httptest.NewServer(p)
+	t.Cleanup(srv.Close)
+	s.URL = srv.URL
+	return s
+}
+
+// SetFaults replaces the default faults for the following requests.
+func (s *Server) SetFaults(f proxy.Faults) {
+	s.live.Set(RuleTest, &f)
+}
+
+// ClearFaults restores the faults the Server was created with.
+func (s *Server) ClearFaults() {
+	s.live.Set("", nil)
+}
+
+// Observe records a completed request.
+func (s *Server) Observe(l *proxy.RequestLog) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logs = append(s.logs, l)
+}
+
+// Requests returns the completed requests matching all the filters.
+func (s *Server) Requests(filters ...Filter) []*proxy.RequestLog {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ls []*proxy.RequestLog
+	for _, l := range s.logs {
+		if matchAll(l, filters) {
+			ls = append(ls, l)
+		}
+	}
+	return ls
+}
+
+// Decisions returns the faults injected into the completed requests
+// matching all the filters.
+func (s *Server) Decisions(filters ...Filter) []proxy.Decision {
+	var ds []proxy.Decision
+	for _, l := range s.Requests(filters...) {
+		ds = append(ds, l.Decisions()...)
+	}
+	return ds
+}
+
+// Reset forgets the requests completed so far.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logs = nil
+}
+
+// AssertMinRequests checks at least n requests matching the filters
+// were completed.
+func (s *Server) AssertMinRequests(t testing.TB, n int, filters ...Filter) {
+	t.Helper()
+	got := s.waitFor(n, func() int { return len(s.Requests(filters...)) })
+	if got < n {
+		t.Errorf("redtapetest: expected at least %d requests, got %d", n, got)
+	}
+}
+
+// AssertRetries checks requests matching the filters were retried
+// at least n times (so at least n+1 requests were completed).
+func (s *Server) AssertRetries(t testing.TB, n int, filters ...Filter) {
+	t.Helper()
+	got := s.waitFor(n+1, func() int { return len(s.Requests(filters...)) })
+	if got < n+1 {
+		t.Errorf("redtapetest: expected at least %d retries (%d requests), got %d requests", n, n+1, got)
+	}
+}
+
+// AssertFaults checks a fault (e.g. proxy.FaultDrop) was injected at
+// least n times into requests matching the filters.
+func (s *Server) AssertFaults(t testing.TB, fault string, n int, filters ...Filter) {
+	t.Helper()
+	count := func() int {
+		c := 0
+		for _, d := range s.Decisions(filters...) {
+			if d.Fault == fault {
+				c++
+			}
+		}
+		return c
+	}
+	if got := s.waitFor(n, count); got < n {
+		t.Errorf("redtapetest: expected at least %d %q faults, got %d", n, fault, got)
+	}
+}
+
+// waitFor waits up to WaitTimeout for count to reach n, returning
+// its last value.
+func (s *Server) waitFor(n int, count func() int) int {
+	deadline := time.Now().Add(WaitTimeout)
+	for {
+		c := count()
+		if c >= n || time.Now().After(deadline) {
+			return c
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// Filter selects requests for assertions.
+type Filter func(l *proxy.RequestLog) bool
+
+// Path selects requests to a path.
+func Path(p string) Filter {
+	return func(l *proxy.RequestLog) bool {
+		u, err := url.Parse(l.URL)
+		return err == nil && u.Path == p
+	}
+}
+
+// Method selects requests with a method.
+func Method(m string) Filter {
+	return func(l *proxy.RequestLog) bool { return l.Method == m }
+}
+
+// Status selects requests answered with a status code.
+func Status(code int) Filter {
+	return func(l *proxy.RequestLog) bool { return l.Status == code }
+}
+
+func matchAll(l *proxy.RequestLog, filters []Filter) bool {
+	for _, f := range filters {
+		if !f(l) {
+			return false
+		}
+	}
+	return true
+}
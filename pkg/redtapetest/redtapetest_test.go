@@ -0,0 +1,46 @@
+package redtapetest_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/a-poor/red-tape/pkg/proxy"
+	"github.com/a-poor/red-tape/pkg/redtapetest"
+)
+
+func TestServer(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer up.Close()
+
+	rt := redtapetest.NewServer(t, up.URL, redtapetest.WithFaults(proxy.Faults{ProbError: 1}))
+
+	// A client retrying until it succeeds...
+	get := func() int {
+		res, err := http.Get(rt.URL + "/api")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	for i := 0; i < 3; i++ {
+		if got := get(); got != http.StatusServiceUnavailable {
+			t.Fatalf("expected status 503, got %d", got)
+		}
+	}
+	rt.SetFaults(proxy.Faults{})
+	if got := get(); got != http.StatusOK {
+		t.Fatalf("expected status 200 after changing faults, got %d", got)
+	}
+
+	rt.AssertRetries(t, 3, redtapetest.Path("/api"))
+	rt.AssertFaults(t, proxy.FaultError, 3)
+	rt.AssertMinRequests(t, 1, redtapetest.Status(http.StatusOK))
+
+	// ...and the original faults can be restored.
+	rt.ClearFaults()
+	if got := get(); got != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503 after clearing faults, got %d", got)
+	}
+}
@@ -0,0 +1,216 @@
+// Package stub is a configurable dummy backend, for trying out and
+// benchmarking red-tape's faults without any other services.
+package stub
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// The kinds of route a stub can serve.
+const (
+	// KindEcho responds with the request's method, URL, headers and
+	// body, as JSON
+	KindEcho = "echo"
+
+	// KindJSON responds with the route's Body, as JSON
+	KindJSON = "json"
+
+	// KindBytes responds with Size random bytes (or the "size" query
+	// parameter)
+	KindBytes = "bytes"
+
+	// KindStream streams Events Server-Sent Events, Interval ms
+	// apart (or the "events" and "interval" query parameters)
+	KindStream = "stream"
+
+	// KindStatus responds with an empty body. Its status can also be
+	// taken from the end of the path (e.g. "/status/503").
+	KindStatus = "status"
+)
+
+// Config configures a stub backend.
+type Config struct {
+	// The address to listen on, either "host:port" or
+	// "unix:///path/to/stub.sock"
+	Listen string `mapstructure:"listen"`
+
+	// The routes to serve (defaults to DefaultRoutes)
+	Routes []Route `mapstructure:"routes"`
+
+	// Logger to use
+	Logger log.Logger `mapstructure:"-"`
+}
+
+// Route is an endpoint served by a stub.
+type Route struct {
+	// The path to serve. Paths ending in "/" match everything under
+	// them, as with http.ServeMux.
+	Path string `mapstructure:"path"`
+
+	// The kind of response (KindEcho, KindJSON, KindBytes, KindStream
+	// or KindStatus)
+	Kind string `mapstructure:"kind"`
+
+	// The response status (defaults to 200)
+	Status int `mapstructure:"status"`
+
+	// The body, for KindJSON
+	Body string `mapstructure:"body"`
+
+	// The number of bytes, for KindBytes
+	Size int `mapstructure:"size"`
+
+	// The number of events and the time between them (ms), for
+	// KindStream
+	Events   int     `mapstructure:"events"`
+	Interval float64 `mapstructure:"interval"`
+
+	// How long to wait before responding (ms). It can also be set
+	// with the "delay" query parameter.
+	Delay float64 `mapstructure:"delay"`
+}
+
+// DefaultRoutes are the routes served if none are configured.
+func DefaultRoutes() []Route {
+	return []Route{
+		{Path: "/echo", Kind: KindEcho},
+		{Path: "/json", Kind: KindJSON, Body: `{"ok":true}`},
+		{Path: "/bytes", Kind: KindBytes, Size: 1024},
+		{Path: "/stream", Kind: KindStream, Events: 10, Interval: 100},
+		{Path: "/slow", Kind: KindStatus, Delay: 1000},
+		{Path: "/status/", Kind: KindStatus},
+		{Path: "/", Kind: KindEcho},
+	}
+}
+
+// MakeHandler creates the handler for a stub backend.
+func MakeHandler(cfg *Config) (http.Handler, error) {
+	routes := cfg.Routes
+	if len(routes) == 0 {
+		routes = DefaultRoutes()
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	mux := http.NewServeMux()
+	seen := map[string]bool{}
+	for i := range routes {
+		rt := routes[i]
+		switch rt.Kind {
+		case KindEcho, KindJSON, KindBytes, KindStream, KindStatus:
+		default:
+			return nil, fmt.Errorf("route %q has unknown kind %q", rt.Path, rt.Kind)
+		}
+		if rt.Kind == KindJSON && !json.Valid([]byte(rt.Body)) {
+			return nil, fmt.Errorf("route %q has an invalid json body", rt.Path)
+		}
+		if !strings.HasPrefix(rt.Path, "/") {
+			return nil, fmt.Errorf("route path %q must start with /", rt.Path)
+		}
+		if seen[rt.Path] {
+			return nil, fmt.Errorf("duplicate route %q", rt.Path)
+		}
+		seen[rt.Path] = true
+		mux.HandleFunc(rt.Path, func(w http.ResponseWriter, r *http.Request) {
+			logger.Debug("Stub request.", "method", r.Method, "url", r.URL, "kind", rt.Kind)
+			rt.serve(w, r)
+		})
+	}
+	return mux, nil
+}
+
+// serve handles a request to the route.
+func (rt *Route) serve(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	// Wait, for slow endpoints...
+	delay := queryFloat(q.Get("delay"), rt.Delay)
+	if delay > 0 {
+		select {
+		case <-time.After(time.Duration(delay * float64(time.Millisecond))):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	status := rt.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	switch rt.Kind {
+	case KindEcho:
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"method":  r.Method,
+			"url":     r.URL.String(),
+			"host":    r.Host,
+			"headers": r.Header,
+			"body":    string(body),
+		})
+
+	case KindJSON:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		io.WriteString(w, rt.Body)
+
+	case KindBytes:
+		n := int(queryFloat(q.Get("size"), float64(rt.Size)))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(n))
+		w.WriteHeader(status)
+		io.CopyN(w, rand.Reader, int64(n))
+
+	case KindStream:
+		events := int(queryFloat(q.Get("events"), float64(rt.Events)))
+		interval := time.Duration(queryFloat(q.Get("interval"), rt.Interval) * float64(time.Millisecond))
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(status)
+		f, _ := w.(http.Flusher)
+		for i := 0; i < events; i++ {
+			if i > 0 {
+				select {
+				case <-time.After(interval):
+				case <-r.Context().Done():
+					return
+				}
+			}
+			fmt.Fprintf(w, "id: %d\ndata: {\"n\":%d}\n\n", i, i)
+			if f != nil {
+				f.Flush()
+			}
+		}
+
+	case KindStatus:
+		if s, err := strconv.Atoi(r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]); err == nil && s >= 100 && s <= 599 {
+			status = s
+		}
+		w.WriteHeader(status)
+	}
+}
+
+// queryFloat parses a query parameter, returning def if it's missing
+// or invalid.
+func queryFloat(s string, def float64) float64 {
+	if s == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 {
+		return def
+	}
+	return f
+}
@@ -0,0 +1,87 @@
+package stub_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/a-poor/red-tape/pkg/stub"
+)
+
+func TestDefaultRoutes(t *testing.T) {
+	h, err := stub.MakeHandler(&stub.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	get := func(path string) (*http.Response, string) {
+		res, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		return res, string(b)
+	}
+
+	if _, body := get("/json"); body != `{"ok":true}` {
+		t.Errorf("unexpected json body %q", body)
+	}
+	if _, body := get("/bytes?size=100"); len(body) != 100 {
+		t.Errorf("expected 100 bytes, got %d", len(body))
+	}
+	if res, _ := get("/status/503"); res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected status 503, got %d", res.StatusCode)
+	}
+	res, body := get("/stream?events=3&interval=1")
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expected an event stream, got %q", ct)
+	}
+	if n := strings.Count(body, "data: "); n != 3 {
+		t.Errorf("expected 3 events, got %d", n)
+	}
+
+	var echo struct{ Method, URL string }
+	_, body = get("/echo?a=1")
+	if err := json.Unmarshal([]byte(body), &echo); err != nil {
+		t.Fatal(err)
+	}
+	if echo.Method != http.MethodGet || echo.URL != "/echo?a=1" {
+		t.Errorf("unexpected echo %+v", echo)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	h, err := stub.MakeHandler(&stub.Config{Routes: []stub.Route{
+		{Path: "/down", Kind: stub.KindStatus, Status: http.StatusBadGateway},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/down")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected status 502, got %d", res.StatusCode)
+	}
+
+	if _, err := stub.MakeHandler(&stub.Config{Routes: []stub.Route{{Path: "/", Kind: "nope"}}}); err == nil {
+		t.Error("expected an error for an unknown kind")
+	}
+	if _, err := stub.MakeHandler(&stub.Config{Routes: []stub.Route{
+		{Path: "/a", Kind: stub.KindEcho},
+		{Path: "/a", Kind: stub.KindStatus},
+	}}); err == nil {
+		t.Error("expected an error for a duplicate route")
+	}
+}